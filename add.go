@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// stringList is a flag which may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func runAdd(args []string) int {
+	var removals stringList
+	var opts pushOptions
+
+	fs := newFlagSet("add")
+	fs.Var(&removals, "remove", "The path removed from TARGET_REF by the new layer, may be given several times")
+	opts.addFlags(fs)
+
+	refs, registries, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 1
+	}
+	if len(refs) < 3 {
+		fmt.Fprintln(os.Stderr, "Error: PATH, TARGET_REF and NEW_REF are required")
+		fs.Usage()
+		return 1
+	}
+	if err := opts.valid(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	logger, closeLog, err := opts.logs.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer closeLog()
+
+	ctx, cancel := newContext(opts.timeout, logger)
+	defer cancel()
+
+	tags, err := rfp.ParseNewTags(refs[1], refs[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	layer := model.LocalLayer{Path: refs[0], Removals: removals}
+	pusher, err := rfp.NewRegistryFakePusherFromLayer(ctx, registries, layer, refs[1], tags...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error when initial push : ", err)
+		return 1
+	}
+	opts.apply(pusher)
+	progress, closeProgress := newProgress(opts.progress, logger)
+	pusher.Progress = progress
+
+	result, err := pusher.FakePush(ctx, "", opts.targetJWT, 1)
+	closeProgress()
+	return report(opts.output, result, err)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+)
+
+func runBatch(args []string) int {
+	var concurrency, webhookRetries int
+	var keyPath, trustedKeys, output, webhookSecret, progressMode string
+	var webhooks stringList
+	var timeout time.Duration
+	var logs logOptions
+	var rates rateOptions
+
+	fs := newFlagSet("batch")
+	fs.IntVar(&concurrency, "concurrency", 0, "The count of entries pushed at the same time (default the one of the plan, or 4)")
+	fs.StringVar(&keyPath, "key", "", "The private key (JWK or PEM) signing the new manifests, generated if missing (default docker's key.json)")
+	fs.StringVar(&trustedKeys, "trusted-keys", "", "The public keys (JWK set or PEM bundle) the images built on must be signed by")
+	fs.Var(&webhooks, "webhook", "POST the result of every entry as a JSON event to this URL, may be given several times")
+	fs.StringVar(&webhookSecret, "webhook-secret", "", "The secret signing the webhook events with HMAC-SHA256")
+	fs.IntVar(&webhookRetries, "webhook-retries", 3, "The count of retries of a failed webhook request")
+	fs.DurationVar(&timeout, "timeout", 0, "Abort the whole batch if it takes longer than this, like 30m (default no timeout)")
+	fs.StringVar(&output, "output", outputText, "The output format of the results, text or json")
+	fs.StringVar(&progressMode, "progress", progressAuto, "Show the progress of the layer transfers on stderr as bars, as log lines or none, auto choosing bars on a terminal")
+	logs.addFlags(fs)
+	rates.addFlags(fs)
+
+	positional, registries, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Error: exactly one PLAN is required")
+		fs.Usage()
+		return 1
+	}
+	if err := validOutput(output); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if err := validProgress(progressMode); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if err := rates.valid(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if concurrency < 0 || webhookRetries < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --concurrency and --webhook-retries must not be negative")
+		return 1
+	}
+	logger, closeLog, err := logs.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer closeLog()
+
+	plan, err := rfp.LoadPlan(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if concurrency > 0 {
+		plan.Concurrency = concurrency
+	}
+
+	ctx, cancel := newContext(timeout, logger)
+	defer cancel()
+
+	progress, closeProgress := newProgress(progressMode, logger)
+	rateLimit := rates.limit()
+	results := rfp.RunPlan(ctx, plan, registries, func(pusher *rfp.RegistryFakePusher) {
+		pusher.TrustKeyPath = keyPath
+		pusher.TrustedKeysPath = trustedKeys
+		pusher.Webhooks = newWebhooks(webhooks, webhookSecret, webhookRetries)
+		pusher.Progress = progress
+		pusher.RateLimit = rateLimit
+	})
+	closeProgress()
+	return reportBatch(output, results)
+}
+
+// reportBatch prints the results of a batch, in a summary table
+// for the text output.
+func reportBatch(output string, results []rfp.BatchResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+
+	if output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tNEW REFERENCES\tSTATUS\tDIGEST\tDURATION\tERROR")
+		for _, result := range results {
+			status := "ok"
+			if result.Error != "" {
+				status = "failed"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", result.Name, strings.Join(result.NewReferences, ","),
+				status, result.Digest, result.Duration.Round(time.Millisecond), result.Error)
+		}
+		tw.Flush()
+		fmt.Printf("\n%d succeeded, %d failed\n", len(results)-failed, failed)
+	}
+
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/config"
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+)
+
+// envPrefix is the prefix of the environment variables setting the options,
+// like RFP_TRUSTED_KEYS for --trusted-keys
+const envPrefix = "RFP_"
+
+// addConfigFlags adds the options selecting the configuration to fs
+func addConfigFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "The configuration file (default $RFP_CONFIG or ~/.config/rfp/config.yaml)")
+	fs.String("profile", "", "The profile of the configuration file to use (default $RFP_PROFILE or the one of the file)")
+}
+
+// applyConfig sets the options of fs not given on the command line, which
+// is parsed already, from the configuration: by increasing precedence the
+// selected profile of the configuration file and the RFP_* environment
+// variables. The Registries of the options of the registries of the
+// profile are returned, nil without profile.
+func applyConfig(fs *flag.FlagSet) (*controller.Registries, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	path, explicit := fs.Lookup("config").Value.String(), given["config"]
+	if !explicit {
+		path, explicit = os.LookupEnv(envPrefix + "CONFIG")
+	}
+	if !explicit {
+		path = config.DefaultPath()
+	}
+	profileName := fs.Lookup("profile").Value.String()
+	if !given["profile"] {
+		profileName = os.Getenv(envPrefix + "PROFILE")
+	}
+
+	var registries *controller.Registries
+	values := make(map[string][]string)
+	file, err := config.Load(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+		if profileName != "" {
+			return nil, fmt.Errorf("profile %s selected without configuration file", profileName)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		profile, err := file.Select(profileName)
+		if err != nil {
+			return nil, err
+		}
+		if profile != nil {
+			if registries, err = profile.NewRegistries(); err != nil {
+				return nil, err
+			}
+			values = profile.OptionValues()
+			if profile.Concurrency > 0 {
+				for _, name := range []string{"concurrency", "workers"} {
+					if _, ok := values[name]; !ok {
+						values[name] = []string{strconv.Itoa(profile.Concurrency)}
+					}
+				}
+			}
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "profile" {
+			return
+		}
+		env, ok := os.LookupEnv(envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1)))
+		if !ok {
+			return
+		}
+		if _, isList := f.Value.(*stringList); isList {
+			values[f.Name] = strings.Split(env, ",")
+		} else {
+			values[f.Name] = []string{env}
+		}
+	})
+
+	for name, vs := range values {
+		if fs.Lookup(name) == nil || given[name] {
+			// the options of the other commands, or overridden by args
+			continue
+		}
+		for _, v := range vs {
+			if err := fs.Set(name, v); err != nil {
+				return nil, fmt.Errorf("invalid value %q of option %s in configuration: %s", v, name, err)
+			}
+		}
+	}
+	return registries, nil
+}
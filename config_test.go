@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseArgsConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+profile: ci
+profiles:
+  ci:
+    concurrency: 8
+    options:
+      key: config.json
+      trusted-keys: config-trusted.json
+      webhook: [https://config.example.com/a, https://config.example.com/b]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"TRUSTED_KEYS", "env-trusted.json")
+
+	for _, test := range []struct {
+		name             string
+		args             []string
+		key, trustedKeys string
+		webhooks         stringList
+		env              string
+	}{
+		{name: "config", args: []string{"--config", path, "plan.yaml"},
+			key: "config.json", trustedKeys: "env-trusted.json",
+			webhooks: stringList{"https://config.example.com/a", "https://config.example.com/b"}},
+		{name: "args", args: []string{"--config", path, "--key", "args.json", "plan.yaml", "--webhook", "https://args.example.com"},
+			key: "args.json", trustedKeys: "env-trusted.json",
+			webhooks: stringList{"https://args.example.com"}},
+		{name: "env", args: []string{"--config=" + path, "-trusted-keys=args-trusted.json", "plan.yaml"},
+			key: "config.json", trustedKeys: "args-trusted.json",
+			webhooks: stringList{"https://env.example.com/a", "https://env.example.com/b"},
+			env:      "https://env.example.com/a,https://env.example.com/b"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv(envPrefix+"WEBHOOK", test.env)
+			}
+			var concurrency int
+			var key, trustedKeys string
+			var webhooks stringList
+			fs := newFlagSet("batch")
+			fs.IntVar(&concurrency, "concurrency", 0, "")
+			fs.StringVar(&key, "key", "", "")
+			fs.StringVar(&trustedKeys, "trusted-keys", "", "")
+			fs.Var(&webhooks, "webhook", "")
+
+			positional, _, err := parseArgs(fs, test.args)
+			if err != nil {
+				t.Fatalf("parseArgs: %s", err)
+			}
+			if !reflect.DeepEqual(positional, []string{"plan.yaml"}) {
+				t.Errorf("positional = %v, want [plan.yaml]", positional)
+			}
+			if concurrency != 8 || key != test.key || trustedKeys != test.trustedKeys {
+				t.Errorf("concurrency, key, trusted-keys = %d, %s, %s, want 8, %s, %s",
+					concurrency, key, trustedKeys, test.key, test.trustedKeys)
+			}
+			if !reflect.DeepEqual(webhooks, test.webhooks) {
+				t.Errorf("webhooks = %v, want %v", webhooks, test.webhooks)
+			}
+		})
+	}
+}
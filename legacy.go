@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// runLegacy runs the deprecated flag based syntax, kept for compatibility.
+func runLegacy(args []string) int {
+
+	var srcRegistry, srcRepository, srcTag, targetRegistry, targetRepository, targetTag, newTag string
+	var isDebug, force, skipVerify bool
+	var expectDigest, trustKey, trustedKeys, output string
+	var srcJWT, targetJWT string
+	var srcLayerCount int
+	var timeout time.Duration
+
+	fs := flag.NewFlagSet("rfp", flag.ContinueOnError)
+	fs.StringVar(&srcRegistry, "srcReg", "registry.example.com", "The domain of source regsitry")
+	fs.StringVar(&srcRepository, "srcRepo", "sourceRepo", "The repository which exists an image layer you want to copy to other repository")
+	fs.StringVar(&srcTag, "srcTag", "sourceTag", "The tag which exists image layer you want to copy to other repository")
+	fs.IntVar(&srcLayerCount, "srcLayerCount", 1, "The layer count of source tag from top to overlay to target tag")
+	fs.StringVar(&targetRegistry, "targetReg", "registry.example.com", "The domain of target regsitry")
+	fs.StringVar(&targetRepository, "targetRepo", "targetRepo", "The repository which exist a tag you want to copy a layer to")
+	fs.StringVar(&targetTag, "targetTag", "targetTag", "The tag which you want to copy a layer to")
+	fs.StringVar(&newTag, "newTag", "newTag", "The tags been generated after the operation, separated by comma")
+	fs.BoolVar(&force, "force", false, "Overwrite newTag if it already exists in target registry")
+	fs.StringVar(&expectDigest, "expectDigest", "", "Optional! Only overwrite newTag if it currently points to this digest")
+	fs.StringVar(&trustKey, "trustKey", "", "Optional! The private key (JWK or PEM) signing the new manifest, generated if missing")
+	fs.BoolVar(&skipVerify, "skipVerify", false, "Do not verify the signatures of source and target manifests")
+	fs.StringVar(&trustedKeys, "trustedKeys", "", "Optional! The public keys (JWK set or PEM bundle) source and target manifests must be signed by")
+	fs.DurationVar(&timeout, "timeout", 0, "Optional! Abort the push if it takes longer than this, like 10m")
+	fs.StringVar(&output, "output", outputText, "The output format of the result, text or json")
+	fs.BoolVar(&isDebug, "debug", false, "Debug mode switch")
+	fs.StringVar(&srcJWT, "srcJWT", "", "Optional! The JWT used to access the source registry and repository")
+	fs.StringVar(&targetJWT, "targetJWT", "", "Optional! The JWT used to access the target registry and repository")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if err := validOutput(output); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+
+	logger, closeLog, err := (&logOptions{isDebug: isDebug, level: log.DefaultLevel}).open()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	defer closeLog()
+
+	ctx, cancel := newContext(timeout, logger)
+	defer cancel()
+
+	pusher, err := rfp.NewRegistryFakePusher(ctx, nil, srcRegistry, srcRepository, srcTag, targetRegistry, targetRepository, targetTag, strings.Split(newTag, ",")...)
+	if err != nil {
+		fmt.Println("Error when initial push : ", err)
+		return 1
+	}
+	pusher.Force = force
+	pusher.ExpectedDigest = expectDigest
+	pusher.TrustKeyPath = trustKey
+	pusher.SkipVerify = skipVerify
+	pusher.TrustedKeysPath = trustedKeys
+
+	result, err := pusher.FakePush(ctx, srcJWT, targetJWT, srcLayerCount)
+	return report(output, result, err)
+}
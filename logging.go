@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// logOptions are the options of the logs of a command
+type logOptions struct {
+	isDebug             bool
+	level, format, file string
+}
+
+func (o *logOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.level, "log-level", log.DefaultLevel, "The least level of the messages logged, debug, info, warn or error")
+	fs.StringVar(&o.format, "log-format", log.FormatText, "The format of the logs, text or json")
+	fs.StringVar(&o.file, "log-file", "", "Append the logs to this file (default stderr)")
+	fs.BoolVar(&o.isDebug, "debug", false, "Debug mode switch, the same as --log-level debug")
+}
+
+// open creates the Logger of the options, closeLog closes the log
+// file once the command is done.
+func (o *logOptions) open() (logger *log.Logger, closeLog func(), err error) {
+	level := o.level
+	if o.isDebug {
+		level = "debug"
+	}
+
+	var out io.Writer = os.Stderr
+	closeLog = func() {}
+	if o.file != "" {
+		f, err := os.OpenFile(o.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error open log file: %s", err)
+		}
+		out = f
+		closeLog = func() { f.Close() }
+	}
+
+	if logger, err = log.New(out, level, o.format); err != nil {
+		closeLog()
+		return nil, nil, err
+	}
+	return logger, closeLog, nil
+}
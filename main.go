@@ -1,55 +1,162 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
 	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
 )
 
+// command is a subcommand of rfp, run returns the exit code of the process.
+type command struct {
+	usage string
+	short string
+	run   func(args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"add": {
+			usage: "rfp add [options] PATH TARGET_REF NEW_REF [NEW_REF...]",
+			short: "Build a layer from the directory or tar file PATH and overlay it on TARGET_REF, pushing the result as NEW_REF",
+			run:   runAdd,
+		},
+		"overlay": {
+			usage: "rfp overlay [options] SRC_REF TARGET_REF NEW_REF [NEW_REF...]",
+			short: "Overlay the top layers of SRC_REF on TARGET_REF, pushing the result as NEW_REF",
+			run:   runOverlay,
+		},
+		"batch": {
+			usage: "rfp batch [options] PLAN",
+			short: "Run the fake pushes described in the YAML file PLAN concurrently",
+			run:   runBatch,
+		},
+		"serve": {
+			usage: "rfp serve [options]",
+			short: "Serve the overlays and rebases as a REST API, running them as queued jobs",
+			run:   runServe,
+		},
+		"verify": {
+			usage: "rfp verify [options] --key PUBLIC_KEY IMAGE_REF",
+			short: "Verify the detached signature of IMAGE_REF",
+			run:   runVerify,
+		},
+	}
+}
+
 // Need use registry v2 API
 // Precondition：
-//    - srcRepository:sourceTag already exists in sourceRegistry
-//    - all the imagelayers to be pushed exist in sourceRegistry
-//    - targetRepository:targetTag already exists in targetRegistry
-//    - newTag is a tag not exist in targetRegistry
+//    - the source image already exists in source registry
+//    - all the imagelayers to be pushed exist in source registry
+//    - the target image already exists in target registry
+//    - the new tags do not exist in target registry, unless -force is given
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
 
-	var srcRegistry, srcRepository, srcTag, targetRegistry, targetRepository, targetTag, newTag string
-	var isDebug bool
-	var srcJWT, targetJWT string
-	var srcLayerCount int
-
-	flag.StringVar(&srcRegistry, "srcReg", "registry.example.com", "The domain of source regsitry")
-	flag.StringVar(&srcRepository, "srcRepo", "sourceRepo", "The repository which exists an image layer you want to copy to other repository")
-	flag.StringVar(&srcTag, "srcTag", "sourceTag", "The tag which exists image layer you want to copy to other repository")
-	flag.IntVar(&srcLayerCount, "srcLayerCount", 1, "The layer count of source tag from top to overlay to target tag")
-	flag.StringVar(&targetRegistry, "targetReg", "registry.example.com", "The domain of target regsitry")
-	flag.StringVar(&targetRepository, "targetRepo", "targetRepo", "The repository which exist a tag you want to copy a layer to")
-	flag.StringVar(&targetTag, "targetTag", "targetTag", "The tag which you want to copy a layer to")
-	flag.StringVar(&newTag, "newTag", "newTag", "The tag been generated after the operation")
-	flag.BoolVar(&isDebug, "debug", false, "Debug mode switch")
-	flag.StringVar(&srcJWT, "srcJWT", "", "Optional! The JWT used to access the source registry and repository")
-	flag.StringVar(&targetJWT, "targetJWT", "", "Optional! The JWT used to access the target registry and repository")
-	flag.Parse()
-
-	if isDebug {
-		log.EnableDebug()
-	}
-
-	pusher, err := rfp.NewRegistryFakePusher(srcRegistry, srcRepository, srcTag, targetRegistry, targetRepository, targetTag, newTag)
-	if err != nil {
-		fmt.Println("Error when initial push : ", err)
+	name := os.Args[1]
+	switch {
+	case name == "help" || name == "-h" || name == "-help" || name == "--help":
+		if len(os.Args) > 2 {
+			if cmd, ok := commands[os.Args[2]]; ok {
+				os.Exit(cmd.run([]string{"-h"}))
+			}
+		}
+		usage()
+		os.Exit(0)
+	case strings.HasPrefix(name, "-"):
+		fmt.Fprintln(os.Stderr, "Warning: the flag based syntax is deprecated, use `rfp overlay SRC_REF TARGET_REF NEW_REF` instead")
+		os.Exit(runLegacy(os.Args[1:]))
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
 		os.Exit(1)
 	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: rfp COMMAND [options] [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
 
-	if err := pusher.FakePush(srcJWT, targetJWT, srcLayerCount); err != nil {
-		fmt.Println("Registry Fake Push failed: ", err)
-		os.Exit(2)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].short)
 	}
 
-	os.Exit(0)
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'rfp help COMMAND' for more information on a command.")
+}
+
+// newFlagSet creates the FlagSet of a command, printing its usage line
+// and options on -h.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\n%s\n\nOptions:\n", commands[name].usage, commands[name].short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
+// parseArgs parses the options of fs which may be mixed with the
+// positional arguments, returning the positional arguments and the
+// Registries of the configuration. The options not given default to
+// the ones of the configuration.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, *controller.Registries, error) {
+	addConfigFlags(fs)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	registries, err := applyConfig(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return nil, nil, err
+	}
+	return positional, registries, nil
+}
+
+// newContext returns the context of a command logging with logger, which
+// is done on interrupt or, if timeout is not zero, once timeout elapsed.
+func newContext(timeout time.Duration, logger *log.Logger) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(log.NewContext(context.Background(), logger), os.Interrupt, syscall.SIGTERM)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+func validOutput(output string) error {
+	if output != outputText && output != outputJSON {
+		return fmt.Errorf("unknown output format %q, must be %s or %s", output, outputText, outputJSON)
+	}
+	return nil
+}
+
+// report prints the result of a FakePush in the output format,
+// returning the exit code of the process.
+func report(output string, result *rfp.Result, err error) int {
+	if output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Registry Fake Push failed: ", err)
+			return 2
+		}
+		return 0
+	}
+
+	if err != nil {
+		fmt.Println("Registry Fake Push failed: ", err)
+		return 2
+	}
+	if len(result.Digests) < 2 {
+		fmt.Println(result.Digest)
+		return 0
+	}
+	for i, dgst := range result.Digests {
+		fmt.Println(dgst, result.NewReferences[i])
+	}
+	return 0
+}
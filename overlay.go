@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// pushOptions are the options of the commands pushing a new image
+// into the target repository.
+type pushOptions struct {
+	timeout                                 time.Duration
+	force, skipVerify                       bool
+	expectDigest, targetJWT, keyPath        string
+	trustedKeys, signKey, ociLayout, output string
+	dockerArchive, compression, progress    string
+	webhooks                                stringList
+	webhookSecret                           string
+	webhookRetries                          int
+	logs                                    logOptions
+	rates                                   rateOptions
+
+	// recompression is parsed from compression by valid
+	recompression *model.Recompression
+}
+
+func (o *pushOptions) addFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.force, "force", false, "Overwrite NEW_REF if it already exists")
+	fs.StringVar(&o.expectDigest, "expect-digest", "", "Only overwrite the first NEW_REF if it currently points to this digest")
+	fs.StringVar(&o.targetJWT, "target-jwt", "", "The JWT used to access the target registry and repository")
+	fs.StringVar(&o.keyPath, "key", "", "The private key (JWK or PEM) signing the new manifest, generated if missing (default docker's key.json)")
+	fs.BoolVar(&o.skipVerify, "skip-verify", false, "Do not verify the signatures of the images built on")
+	fs.StringVar(&o.trustedKeys, "trusted-keys", "", "The public keys (JWK set or PEM bundle) the images built on must be signed by")
+	fs.StringVar(&o.signKey, "sign-key", "", "The ECDSA or ed25519 private key (PEM) producing a detached signature of NEW_REF")
+	fs.StringVar(&o.ociLayout, "oci-layout", "", "Write the new image into this OCI image layout directory instead of pushing it")
+	fs.StringVar(&o.dockerArchive, "docker-archive", "", "Write the new image into this tar file loadable by docker load instead of pushing it")
+	fs.StringVar(&o.compression, "compression", "", "Recompress the overlaid layers as gzip or zstd, with an optional level like gzip:9 or zstd:19")
+	fs.Var(&o.webhooks, "webhook", "POST the result as a JSON event to this URL once done, may be given several times")
+	fs.StringVar(&o.webhookSecret, "webhook-secret", "", "The secret signing the webhook events with HMAC-SHA256")
+	fs.IntVar(&o.webhookRetries, "webhook-retries", 3, "The count of retries of a failed webhook request")
+	fs.DurationVar(&o.timeout, "timeout", 0, "Abort the push if it takes longer than this, like 10m (default no timeout)")
+	fs.StringVar(&o.output, "output", outputText, "The output format of the result, text or json")
+	fs.StringVar(&o.progress, "progress", progressAuto, "Show the progress of the layer transfers on stderr as bars, as log lines or none, auto choosing bars on a terminal")
+	o.logs.addFlags(fs)
+	o.rates.addFlags(fs)
+}
+
+// valid checks the options once parsed.
+func (o *pushOptions) valid() error {
+	if err := validOutput(o.output); err != nil {
+		return err
+	}
+	if err := validProgress(o.progress); err != nil {
+		return err
+	}
+	if o.compression != "" {
+		rc, err := model.ParseRecompression(o.compression)
+		if err != nil {
+			return err
+		}
+		o.recompression = &rc
+	}
+	if o.webhookRetries < 0 {
+		return fmt.Errorf("--webhook-retries must not be negative")
+	}
+	return o.rates.valid()
+}
+
+func (o *pushOptions) apply(pusher *rfp.RegistryFakePusher) {
+	pusher.Force = o.force
+	pusher.ExpectedDigest = o.expectDigest
+	pusher.TrustKeyPath = o.keyPath
+	pusher.SkipVerify = o.skipVerify
+	pusher.TrustedKeysPath = o.trustedKeys
+	pusher.SignatureKeyPath = o.signKey
+	pusher.OCILayoutPath = o.ociLayout
+	pusher.DockerArchivePath = o.dockerArchive
+	pusher.Recompression = o.recompression
+	pusher.Webhooks = newWebhooks(o.webhooks, o.webhookSecret, o.webhookRetries)
+	pusher.RateLimit = o.rates.limit()
+}
+
+// newWebhooks creates the webhooks of urls, which share secret and retries
+func newWebhooks(urls []string, secret string, retries int) []rfp.Webhook {
+	var hooks []rfp.Webhook
+	for _, url := range urls {
+		hooks = append(hooks, rfp.Webhook{URL: url, Secret: secret, Retries: retries})
+	}
+	return hooks
+}
+
+func runOverlay(args []string) int {
+	var layers int
+	var srcJWT string
+	var opts pushOptions
+
+	fs := newFlagSet("overlay")
+	fs.IntVar(&layers, "layers", 1, "The layer count of SRC_REF from top to overlay on TARGET_REF")
+	fs.StringVar(&srcJWT, "src-jwt", "", "The JWT used to access the source registry and repository")
+	opts.addFlags(fs)
+
+	refs, registries, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 1
+	}
+	if len(refs) < 3 {
+		fmt.Fprintln(os.Stderr, "Error: SRC_REF, TARGET_REF and NEW_REF are required")
+		fs.Usage()
+		return 1
+	}
+	if err := opts.valid(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if layers < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --layers must be at least 1")
+		return 1
+	}
+
+	logger, closeLog, err := opts.logs.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer closeLog()
+
+	ctx, cancel := newContext(opts.timeout, logger)
+	defer cancel()
+
+	tags, err := rfp.ParseNewTags(refs[1], refs[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	pusher, err := rfp.NewRegistryFakePusherFromReferences(ctx, registries, refs[0], refs[1], tags...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error when initial push : ", err)
+		return 1
+	}
+	opts.apply(pusher)
+	progress, closeProgress := newProgress(opts.progress, logger)
+	pusher.Progress = progress
+
+	result, err := pusher.FakePush(ctx, srcJWT, opts.targetJWT, layers)
+	closeProgress()
+	return report(opts.output, result, err)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/units"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// The modes of the progress of the layer transfers
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressLog  = "log"
+	progressNone = "none"
+)
+
+const (
+	// barWidth is the count of characters of the progress bars
+	barWidth = 30
+
+	// barRefresh is the least interval between two draws of the bars
+	barRefresh = 100 * time.Millisecond
+
+	// progressLogInterval is the interval between two log lines of a transfer
+	progressLogInterval = 5 * time.Second
+)
+
+func validProgress(mode string) error {
+	switch mode {
+	case progressAuto, progressBar, progressLog, progressNone:
+		return nil
+	}
+	return fmt.Errorf("unknown progress %q, must be auto, bar, log or none", mode)
+}
+
+// newProgress creates the controller.Progress of mode, drawing bars on
+// stderr, or logging with logger every progressLogInterval. The auto mode
+// draws bars if stderr is a terminal and logs otherwise. The messages
+// logged to stderr are written above the bars, closeProgress draws the
+// bars a last time once the transfers are done.
+func newProgress(mode string, logger *log.Logger) (progress controller.Progress, closeProgress func()) {
+	if mode == progressAuto {
+		mode = progressLog
+		if isTerminal(os.Stderr) {
+			mode = progressBar
+		}
+	}
+
+	switch mode {
+	case progressBar:
+		bars := &barProgress{w: os.Stderr, index: make(map[string]*transfer)}
+		if logger.Logger.Out == os.Stderr {
+			logger.Logger.Out = bars
+		}
+		return bars, bars.close
+	case progressLog:
+		return &logProgress{logger: logger, transfers: make(map[string]*loggedTransfer)}, func() {}
+	}
+	return nil, func() {}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// transfer is the progress of a blob
+type transfer struct {
+	dgst, direction string
+	done, total     int64
+}
+
+func (t *transfer) String() string {
+	name := strings.TrimPrefix(t.dgst, "sha256:")
+	if len(name) > 12 {
+		name = name[:12]
+	}
+	if t.total <= 0 {
+		return fmt.Sprintf("%s  %-8s  %s", name, t.direction, units.BytesSize(float64(t.done)))
+	}
+
+	filled := int(int64(barWidth) * t.done / t.total)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("%s  %-8s  [%s]  %s/%s", name, t.direction, bar,
+		units.BytesSize(float64(t.done)), units.BytesSize(float64(t.total)))
+}
+
+// barProgress draws a progress bar per blob on a terminal, redrawing
+// all of them in place on updates.
+type barProgress struct {
+	mu        sync.Mutex
+	w         io.Writer
+	transfers []*transfer
+	index     map[string]*transfer
+	lines     int
+	drawn     time.Time
+	dirty     bool
+	closed    bool
+}
+
+func (p *barProgress) Update(dgst, direction string, done, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.index[dgst]
+	if !ok {
+		t = &transfer{dgst: dgst}
+		p.index[dgst] = t
+		p.transfers = append(p.transfers, t)
+	}
+	t.direction, t.done, t.total = direction, done, total
+
+	if ok && done != total && time.Since(p.drawn) < barRefresh {
+		p.dirty = true
+		return
+	}
+	p.draw()
+}
+
+// Write writes the log messages b above the bars
+func (p *barProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.lines == 0 {
+		return p.w.Write(b)
+	}
+	fmt.Fprintf(p.w, "\x1b[%dA\x1b[J", p.lines)
+	p.lines = 0
+	n, err := p.w.Write(b)
+	p.draw()
+	return n, err
+}
+
+// draw moves the cursor up to the first bar and draws them all
+func (p *barProgress) draw() {
+	var b strings.Builder
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.lines)
+	}
+	for _, t := range p.transfers {
+		fmt.Fprintf(&b, "\x1b[2K%s\n", t)
+	}
+	io.WriteString(p.w, b.String())
+	p.lines = len(p.transfers)
+	p.drawn = time.Now()
+	p.dirty = false
+}
+
+func (p *barProgress) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dirty {
+		p.draw()
+	}
+	p.closed = true
+}
+
+// logProgress logs the progress of the transfers every progressLogInterval,
+// and their end if they took that long, so the small blobs are not logged.
+type logProgress struct {
+	mu        sync.Mutex
+	logger    *log.Logger
+	transfers map[string]*loggedTransfer
+}
+
+// loggedTransfer is the state of a transfer logged by logProgress
+type loggedTransfer struct {
+	last             time.Time
+	logged, complete bool
+}
+
+func (p *logProgress) Update(dgst, direction string, done, total int64) {
+	if !p.shouldLog(direction+" "+dgst, done == total) {
+		return
+	}
+
+	logger := p.logger.WithField(log.FieldDigest, dgst)
+	if total <= 0 {
+		logger.Infof("%s %s", direction, units.BytesSize(float64(done)))
+		return
+	}
+	logger.Infof("%s %s of %s (%d%%)", direction, units.BytesSize(float64(done)),
+		units.BytesSize(float64(total)), 100*done/total)
+}
+
+// shouldLog tells whether the update of the transfer key is logged
+func (p *logProgress) shouldLog(key string, complete bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	t, ok := p.transfers[key]
+	switch {
+	case !ok:
+		p.transfers[key] = &loggedTransfer{last: now, complete: complete}
+		return false
+	case t.complete:
+		return false
+	case complete:
+		t.complete = true
+		return t.logged
+	case now.Sub(t.last) >= progressLogInterval:
+		t.last, t.logged = now, true
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/docker/docker/pkg/units"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+)
+
+// rateOptions are the bandwidth limits of the layer transfers of a command
+type rateOptions struct {
+	global, perTransfer string
+
+	// the bytes per second parsed by valid, 0 being unlimited
+	globalRate, perTransferRate int64
+}
+
+func (o *rateOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.global, "limit-rate", "", "Limit the bandwidth of all the layer transfers together to these bytes per second, like 512k or 10m (default unlimited)")
+	fs.StringVar(&o.perTransfer, "limit-rate-per-transfer", "", "Limit the bandwidth of each layer transfer to these bytes per second, like 512k or 10m (default unlimited)")
+}
+
+// valid parses the rates once the flags are parsed.
+func (o *rateOptions) valid() (err error) {
+	if o.globalRate, err = parseRate("--limit-rate", o.global); err != nil {
+		return err
+	}
+	o.perTransferRate, err = parseRate("--limit-rate-per-transfer", o.perTransfer)
+	return err
+}
+
+func parseRate(flag, rate string) (int64, error) {
+	if rate == "" {
+		return 0, nil
+	}
+	n, err := units.RAMInBytes(rate)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be bytes per second like 512k or 10m", flag, rate)
+	}
+	return n, nil
+}
+
+// limit creates the RateLimit of the options, shared by all the pushes
+// of the command, or nil if unlimited.
+func (o *rateOptions) limit() *controller.RateLimit {
+	if o.globalRate == 0 && o.perTransferRate == 0 {
+		return nil
+	}
+	return controller.NewRateLimit(o.globalRate, o.perTransferRate)
+}
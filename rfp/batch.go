@@ -0,0 +1,205 @@
+package rfp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// defaultConcurrency is the count of the entries of a Plan run at the same time
+const defaultConcurrency = 4
+
+// Plan is a batch of fake pushes, read from a YAML file like:
+//
+//	concurrency: 8
+//	defaults:
+//	  source: registry.example.com/app:build-42
+//	  newReferences: [app-42]
+//	entries:
+//	  - target: registry.example.com/runtime-py2:1.0
+//	  - target: registry.example.com/runtime-py3:1.0
+//	    compression: zstd
+type Plan struct {
+	// Concurrency is the count of the entries run at the same time
+	Concurrency int `yaml:"concurrency"`
+
+	// Defaults are the options of the entries not giving them,
+	// a boolean option set in Defaults applies to every entry
+	Defaults PlanEntry `yaml:"defaults"`
+
+	Entries []PlanEntry `yaml:"entries"`
+}
+
+// PlanEntry is an overlay of Layers layers of Source on Target,
+// pushed as NewReferences
+type PlanEntry struct {
+	// Name identifies the entry in the summary, its target if empty
+	Name string `yaml:"name"`
+
+	Source        string   `yaml:"source"`
+	Target        string   `yaml:"target"`
+	NewReferences []string `yaml:"newReferences"`
+
+	// Layers is the count of the layers of Source to overlay, 1 if 0
+	Layers int `yaml:"layers"`
+
+	Force          bool   `yaml:"force"`
+	SkipVerify     bool   `yaml:"skipVerify"`
+	ExpectedDigest string `yaml:"expectedDigest"`
+	Compression    string `yaml:"compression"`
+	SignKey        string `yaml:"signKey"`
+}
+
+// BatchResult is the report of an entry of a Plan
+type BatchResult struct {
+	Name string `json:"name"`
+	*Result
+}
+
+// LoadPlan reads the Plan in the YAML file path, applying the defaults
+// to the entries, which are checked.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan Plan
+	if err := yaml.UnmarshalStrict(data, &plan); err != nil {
+		return nil, fmt.Errorf("error parse plan %s: %s", path, err)
+	}
+	if len(plan.Entries) == 0 {
+		return nil, fmt.Errorf("no entry in plan %s", path)
+	}
+	if plan.Concurrency < 0 {
+		return nil, fmt.Errorf("concurrency of plan %s must not be negative", path)
+	}
+	if plan.Concurrency == 0 {
+		plan.Concurrency = defaultConcurrency
+	}
+
+	for i := range plan.Entries {
+		e := &plan.Entries[i]
+		e.applyDefaults(plan.Defaults)
+		if err := e.valid(); err != nil {
+			return nil, fmt.Errorf("error in entry %d of plan %s: %s", i+1, path, err)
+		}
+	}
+	return &plan, nil
+}
+
+func (e *PlanEntry) applyDefaults(d PlanEntry) {
+	if e.Source == "" {
+		e.Source = d.Source
+	}
+	if e.Target == "" {
+		e.Target = d.Target
+	}
+	if len(e.NewReferences) == 0 {
+		e.NewReferences = d.NewReferences
+	}
+	if e.Layers == 0 {
+		e.Layers = d.Layers
+	}
+	if e.Compression == "" {
+		e.Compression = d.Compression
+	}
+	if e.SignKey == "" {
+		e.SignKey = d.SignKey
+	}
+	e.Force = e.Force || d.Force
+	e.SkipVerify = e.SkipVerify || d.SkipVerify
+}
+
+func (e *PlanEntry) valid() error {
+	if e.Source == "" || e.Target == "" {
+		return fmt.Errorf("source and target are required")
+	}
+	if len(e.NewReferences) == 0 {
+		return fmt.Errorf("at least one new reference is needed")
+	}
+	if _, err := ParseNewTags(e.Target, e.NewReferences); err != nil {
+		return err
+	}
+	if e.Layers < 0 {
+		return fmt.Errorf("layers must be at least 1")
+	}
+	if e.Layers == 0 {
+		e.Layers = 1
+	}
+	if e.Compression != "" {
+		if _, err := model.ParseRecompression(e.Compression); err != nil {
+			return err
+		}
+	}
+	if e.Name == "" {
+		e.Name = e.Target
+	}
+	return nil
+}
+
+// RunPlan runs the entries of plan, Concurrency of them at the same time,
+// sharing the tokens and the transferred blobs, and accessing the registries
+// with their options in registries. configure, if set, applies the options
+// common to all the entries, like the trust key. The results are in the
+// order of the entries, the failed ones have their Error set.
+func RunPlan(ctx context.Context, plan *Plan, registries *controller.Registries, configure func(pusher *RegistryFakePusher)) []BatchResult {
+	cache := NewPushCache()
+	defer cache.Close()
+	results := make([]BatchResult, len(plan.Entries))
+	sem := make(chan struct{}, plan.Concurrency)
+	var wg sync.WaitGroup
+	for i := range plan.Entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			e := &plan.Entries[i]
+			result, err := e.run(log.WithFields(ctx, log.Fields{"entry": e.Name}), cache, registries, configure)
+			if result == nil {
+				result = &Result{Source: e.Source, Target: e.Target, NewReferences: e.NewReferences}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results[i] = BatchResult{Name: e.Name, Result: result}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func (e *PlanEntry) run(ctx context.Context, cache *PushCache, registries *controller.Registries, configure func(pusher *RegistryFakePusher)) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tags, err := ParseNewTags(e.Target, e.NewReferences)
+	if err != nil {
+		return nil, err
+	}
+	pusher, err := NewRegistryFakePusherFromReferences(ctx, registries, e.Source, e.Target, tags...)
+	if err != nil {
+		return nil, err
+	}
+	if configure != nil {
+		configure(pusher)
+	}
+	pusher.Force = e.Force
+	pusher.SkipVerify = e.SkipVerify
+	pusher.ExpectedDigest = e.ExpectedDigest
+	pusher.SignatureKeyPath = e.SignKey
+	if e.Compression != "" {
+		rc, _ := model.ParseRecompression(e.Compression)
+		pusher.Recompression = &rc
+	}
+	pusher.Cache = cache
+	return pusher.FakePush(ctx, "", "", e.Layers)
+}
@@ -0,0 +1,236 @@
+package rfp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+)
+
+func writePlan(t *testing.T, plan string) string {
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	if err := ioutil.WriteFile(path, []byte(plan), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPlan(t *testing.T) {
+	path := writePlan(t, `
+defaults:
+  source: registry.example.com/app:1
+  newReferences: [app-1]
+  force: true
+entries:
+  - target: registry.example.com/runtime-py2:1.0
+  - name: py3
+    target: registry.example.com/runtime-py3:1.0
+    newReferences: [app-1-zstd]
+    layers: 2
+    compression: zstd
+`)
+	plan, err := LoadPlan(path)
+	if err != nil {
+		t.Fatalf("LoadPlan: %s", err)
+	}
+	if plan.Concurrency != defaultConcurrency {
+		t.Errorf("concurrency = %d, want %d", plan.Concurrency, defaultConcurrency)
+	}
+	if len(plan.Entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(plan.Entries))
+	}
+
+	py2, py3 := plan.Entries[0], plan.Entries[1]
+	if py2.Name != "registry.example.com/runtime-py2:1.0" || py2.Source != "registry.example.com/app:1" ||
+		py2.NewReferences[0] != "app-1" || py2.Layers != 1 || !py2.Force {
+		t.Errorf("defaults not applied: %+v", py2)
+	}
+	if py3.Name != "py3" || py3.NewReferences[0] != "app-1-zstd" || py3.Layers != 2 || py3.Compression != "zstd" {
+		t.Errorf("options of the entry overridden: %+v", py3)
+	}
+}
+
+func TestLoadPlanErrors(t *testing.T) {
+	for _, tc := range []struct {
+		plan, err string
+	}{
+		{"entries: []", "no entry"},
+		{"entries:\n  - target: r.example.com/base:1\n    newReferences: [x]", "source and target are required"},
+		{"entries:\n  - source: r.example.com/app:1\n    target: r.example.com/base:1", "at least one new reference"},
+		{"entries:\n  - source: r.example.com/app:1\n    target: r.example.com/base:1\n    newReferences: [x]\n    compression: lz4", "lz4"},
+		{"entries:\n  - source: r.example.com/app:1\n    target: r.example.com/base:1\n    newReferences: [x]\n    unknown: 1", "unknown"},
+		{"concurrency: -1\nentries:\n  - source: r.example.com/app:1\n    target: r.example.com/base:1\n    newReferences: [x]", "concurrency"},
+	} {
+		_, err := LoadPlan(writePlan(t, tc.plan))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: error = %v, want %q", tc.plan, err, tc.err)
+		}
+	}
+}
+
+func TestRunPlan(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	src.SetAuth(rfptest.AuthBearer, "ci", "secret")
+	target.SetAuth(rfptest.AuthBearer, "ci", "secret")
+	t.Setenv("DOCKER_CONFIG", rfptest.WriteDockerConfig(t, "ci", "secret", src.Host(), target.Host()))
+	if _, err := src.PutImage("app", "1", nil, baseLayer, appLayer); err != nil {
+		t.Fatal(err)
+	}
+	for _, repository := range []string{"py2", "py3", "go"} {
+		if _, err := target.PutImage(repository, "1", nil, baseLayer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan := &Plan{Concurrency: 2}
+	for _, repository := range []string{"py2", "py3", "go"} {
+		plan.Entries = append(plan.Entries, PlanEntry{
+			Name:          repository,
+			Source:        src.Host() + "/app:1",
+			Target:        target.Host() + "/" + repository + ":1",
+			NewReferences: []string{"app-1"},
+			Layers:        1,
+		})
+	}
+	// the tag already exists and force is not given
+	plan.Entries = append(plan.Entries, PlanEntry{
+		Name:          "existing",
+		Source:        src.Host() + "/app:1",
+		Target:        target.Host() + "/go:1",
+		NewReferences: []string{"1"},
+		Layers:        1,
+	})
+
+	keyPath := filepath.Join(t.TempDir(), "key.json")
+	results := RunPlan(context.Background(), plan, nil, func(pusher *RegistryFakePusher) {
+		pusher.TrustKeyPath = keyPath
+	})
+
+	if len(results) != 4 {
+		t.Fatalf("%d results, want 4", len(results))
+	}
+	for i, result := range results[:3] {
+		if result.Name != plan.Entries[i].Name {
+			t.Errorf("result %d is the one of %s, want %s", i, result.Name, plan.Entries[i].Name)
+		}
+		if result.Error != "" {
+			t.Errorf("%s failed: %s", result.Name, result.Error)
+			continue
+		}
+		if _, ok := target.Manifest(result.Name, "app-1"); !ok {
+			t.Errorf("%s:app-1 not pushed", result.Name)
+		}
+		if len(result.Layers) != 1 || result.Layers[0].Mode != model.TransferCopied {
+			t.Errorf("%s: layers = %+v, want copied", result.Name, result.Layers)
+		}
+	}
+	if results[3].Error == "" || !strings.Contains(results[3].Error, "already exists") {
+		t.Errorf("existing: error = %q, want already exists", results[3].Error)
+	}
+
+	// the app layer is downloaded once, and a token requested once per repository
+	appBlob := "/v2/app/blobs/" + blobSum(appLayer).String()
+	downloads, tokens := 0, 0
+	for _, req := range src.Requests() {
+		switch {
+		case req.Method == "GET" && req.Path == appBlob:
+			downloads++
+		case strings.HasPrefix(req.Path, "/token"):
+			tokens++
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("app layer downloaded %d times, want 1", downloads)
+	}
+	if tokens != 1 {
+		t.Errorf("%d tokens requested from the source registry, want 1", tokens)
+	}
+}
+
+func TestPushCacheSkipsTransferredBlobs(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	cache := NewPushCache()
+	defer cache.Close()
+	var modes []model.TransferMode
+	for _, tag := range []string{"2", "3"} {
+		pusher := newTestPusher(t, reg, reg, tag)
+		pusher.Cache = cache
+		result, err := pusher.FakePush(context.Background(), "", "", 1)
+		if err != nil {
+			t.Fatalf("FakePush: %s", err)
+		}
+		modes = append(modes, result.Layers[0].Mode)
+		if result.Layers[0].Size != int64(len(appLayer)) {
+			t.Errorf("size = %d, want %d", result.Layers[0].Size, len(appLayer))
+		}
+	}
+	if modes[0] != model.TransferMounted || modes[1] != model.TransferSkipped {
+		t.Errorf("modes = %v, want mounted then skipped", modes)
+	}
+}
+
+func TestPushCacheKeepsBlobsOnDisk(t *testing.T) {
+	src := rfptest.NewRegistry()
+	defer src.Close()
+	target := rfptest.NewRegistry()
+	defer target.Close()
+	putTestImages(t, src, target)
+
+	cache := NewPushCache()
+	keyPath := filepath.Join(t.TempDir(), "key.json")
+	for _, repository := range []string{"base-2", "base-3"} {
+		if _, err := target.PutImage(repository, "1", nil, baseLayer); err != nil {
+			t.Fatal(err)
+		}
+		pusher, err := NewRegistryFakePusherFromReferences(context.Background(), nil,
+			src.Host()+"/app:1", target.Host()+"/"+repository+":1", "2")
+		if err != nil {
+			t.Fatalf("NewRegistryFakePusherFromReferences: %s", err)
+		}
+		pusher.TrustKeyPath = keyPath
+		pusher.Cache = cache
+		if _, err := pusher.FakePush(context.Background(), "", "", 1); err != nil {
+			t.Fatalf("FakePush into %s: %s", repository, err)
+		}
+	}
+
+	// the blob is kept as a file rather than in memory
+	appBlob := blobSum(appLayer).String()
+	path, ok := cache.contents[appBlob].value.(string)
+	if !ok {
+		t.Fatalf("cached app layer = %T, want the path of its file", cache.contents[appBlob].value)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(content, appLayer) {
+		t.Errorf("cached app layer file holds %d bytes, %v, want the app layer", len(content), err)
+	}
+	if content, _ := target.Blob("base-3", appBlob); !bytes.Equal(content, appLayer) {
+		t.Error("app layer not copied from the cache into base-3")
+	}
+	downloads := 0
+	for _, req := range src.Requests() {
+		if req.Method == "GET" && req.Path == "/v2/app/blobs/"+appBlob {
+			downloads++
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("app layer downloaded %d times, want 1", downloads)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Errorf("cache directory left after Close: %v", err)
+	}
+}
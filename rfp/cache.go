@@ -0,0 +1,181 @@
+package rfp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// PushCache shares the auth tokens and the transferred blobs among the
+// pushes of a batch, so each token is requested and each blob transferred
+// into a repository only once. It is safe for concurrent use, the tokens
+// are not refreshed so it is not meant to outlive the batch.
+type PushCache struct {
+	mu     sync.Mutex
+	tokens map[string]*cacheCall
+	blobs  map[string]*cacheCall
+
+	// contents are the files of the blobs downloaded to be copied, kept in
+	// dir to be copied into other repositories without downloading them
+	// again, rather than holding all of them in memory
+	contents map[string]*cacheCall
+	dir      string
+}
+
+// cacheCall is the computation of a value of the cache, done once
+// by the first caller while the others wait for it.
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// blobTransfer is the value of a blob transferred into a repository
+type blobTransfer struct {
+	mode model.TransferMode
+	size int64
+}
+
+// NewPushCache creates an empty PushCache, which must be closed to
+// remove the blobs it keeps on disk.
+func NewPushCache() *PushCache {
+	return &PushCache{
+		tokens:   make(map[string]*cacheCall),
+		blobs:    make(map[string]*cacheCall),
+		contents: make(map[string]*cacheCall),
+	}
+}
+
+// do returns the value of key in calls, computed by f if missing. The
+// callers of the same key wait for the first one, which tells whether
+// it computed the value. Failures are not cached, the next caller
+// tries again.
+func (c *PushCache) do(calls map[string]*cacheCall, key string, f func() (interface{}, error)) (interface{}, bool, error) {
+	c.mu.Lock()
+	if call, ok := calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return c.do(calls, key, f)
+		}
+		return call.value, false, nil
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	calls[key] = call
+	c.mu.Unlock()
+
+	call.value, call.err = f()
+	if call.err != nil {
+		c.mu.Lock()
+		delete(calls, key)
+		c.mu.Unlock()
+	}
+	close(call.done)
+	return call.value, true, call.err
+}
+
+// Close removes the blobs kept on disk, the PushCache must not be used
+// afterwards.
+func (c *PushCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(c.dir)
+	c.dir = ""
+	return err
+}
+
+// spool writes content, the blob dgst, into a file of the directory of the
+// cache, which is created if missing, returning the file.
+func (c *PushCache) spool(dgst string, content []byte) (string, error) {
+	c.mu.Lock()
+	if c.dir == "" {
+		dir, err := ioutil.TempDir("", "rfp-cache-")
+		if err != nil {
+			c.mu.Unlock()
+			return "", fmt.Errorf("error creating cache directory: %s", err)
+		}
+		c.dir = dir
+	}
+	dir := c.dir
+	c.mu.Unlock()
+
+	path := filepath.Join(dir, strings.Replace(dgst, ":", "-", 1))
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return "", fmt.Errorf("error caching blob %s: %s", dgst, err)
+	}
+	return path, nil
+}
+
+// auth returns the RegistryAuth to access the repository of loc, whose
+// registry has its options in registries
+func (c *PushCache) auth(ctx context.Context, loc model.ImageLocation, registries *controller.Registries) (model.RegistryAuth, error) {
+	auth, _, err := c.do(c.tokens, loc.Registry+"/"+loc.Repository, func() (interface{}, error) {
+		return controller.NewAuthController("", "", registries).Authenticate(ctx, loc.Registry, loc.Repository)
+	})
+	if err != nil {
+		return model.RegistryAuth{}, err
+	}
+	return auth.(model.RegistryAuth), nil
+}
+
+// transfer transfers the blob of bc into the repository of tLoc, unless
+// it is already done by another push, which makes it skipped. The blob
+// is downloaded only once to be copied into several repositories, the
+// other copies read it from disk.
+func (c *PushCache) transfer(ctx context.Context, tLoc model.ImageLocation, bc *controller.BlobController) (model.TransferMode, error) {
+	bc.Download = func(ctx context.Context) ([]byte, error) {
+		var content []byte
+		path, first, err := c.do(c.contents, bc.BlobSum, func() (interface{}, error) {
+			var err error
+			if content, err = bc.Fetch(ctx); err != nil {
+				return nil, err
+			}
+			return c.spool(bc.BlobSum, content)
+		})
+		if first && content != nil {
+			// failing to keep the blob, the other copies download it again
+			if err != nil {
+				log.FromContext(ctx).WithField(log.FieldDigest, bc.BlobSum).Warnf("%s", err)
+			}
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if content, err = ioutil.ReadFile(path.(string)); err != nil {
+			return nil, fmt.Errorf("error reading cached blob %s: %s", bc.BlobSum, err)
+		}
+		return content, nil
+	}
+
+	key := tLoc.Registry + "/" + tLoc.Repository + "@" + bc.BlobSum
+	value, first, err := c.do(c.blobs, key, func() (interface{}, error) {
+		mode, err := bc.Transfer(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return blobTransfer{mode: mode, size: bc.Size}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	transfer := value.(blobTransfer)
+	bc.Size = transfer.size
+	if !first {
+		return model.TransferSkipped, nil
+	}
+	return transfer.mode, nil
+}
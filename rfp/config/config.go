@@ -0,0 +1,188 @@
+// Package config reads the configuration file of rfp, which holds named
+// profiles of the registries accessed and of the default options:
+//
+//	profile: prod
+//	profiles:
+//	  prod:
+//	    concurrency: 8
+//	    registries:
+//	      - url: https://registry.example.com
+//	        ca: /etc/rfp/registry-ca.pem
+//	        credentials: env:PROD
+//	        retries: 3
+//	        retryBackoff: 1s
+//	    options:
+//	      key: /etc/rfp/key.json
+//	      compression: zstd
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/homedir"
+	"gopkg.in/yaml.v2"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// File is the content of the configuration file
+type File struct {
+	// Profile is the profile used when none is selected
+	Profile string `yaml:"profile"`
+
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Profile is a named set of registries and options
+type Profile struct {
+	Registries []Registry `yaml:"registries"`
+
+	// Concurrency is the count of the pushes run at the same time
+	// by the batches and the server
+	Concurrency int `yaml:"concurrency"`
+
+	// Options are the default values of the command line options,
+	// by their names like trusted-keys
+	Options map[string]interface{} `yaml:"options"`
+}
+
+// Registry are the options of the connections to a registry
+type Registry struct {
+	// URL is the registry, like https://registry.example.com or
+	// registry.example.com:5000, its scheme is probed if not given
+	URL string `yaml:"url"`
+
+	// Scheme is http or https, overriding the one of URL
+	Scheme string `yaml:"scheme"`
+
+	// CA is a PEM bundle of the certificate authorities of the registry
+	CA string `yaml:"ca"`
+
+	// Insecure disables the verification of the certificate of the registry
+	Insecure bool `yaml:"insecure"`
+
+	// Credentials is docker, none, env or env:PREFIX, docker if empty
+	Credentials string `yaml:"credentials"`
+
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+}
+
+// DefaultPath returns the location of the configuration file,
+// config.yaml in the rfp directory of XDG_CONFIG_HOME or ~/.config
+func DefaultPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(homedir.Get(), ".config")
+	}
+	return filepath.Join(dir, "rfp", "config.yaml")
+}
+
+// Load reads the configuration file path
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("error parse config %s: %s", path, err)
+	}
+	for name, p := range f.Profiles {
+		for _, r := range p.Registries {
+			if _, _, err := r.Options(); err != nil {
+				return nil, fmt.Errorf("error in profile %s of config %s: %s", name, path, err)
+			}
+		}
+		if p.Concurrency < 0 {
+			return nil, fmt.Errorf("error in profile %s of config %s: concurrency must not be negative", name, path)
+		}
+	}
+	return &f, nil
+}
+
+// Select returns the profile name, or the default Profile of the file
+// if name is empty. It returns nil if no profile is selected at all.
+func (f *File) Select(name string) (*Profile, error) {
+	if name == "" {
+		name = f.Profile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := f.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(f.Profiles))
+		for n := range f.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q, the profiles are %s", name, strings.Join(names, ", "))
+	}
+	return &p, nil
+}
+
+// Options returns the host of the registry and the options of its connections
+func (r Registry) Options() (string, model.RegistryOptions, error) {
+	opts := model.RegistryOptions{
+		Scheme:       r.Scheme,
+		CAFile:       r.CA,
+		Insecure:     r.Insecure,
+		Credentials:  r.Credentials,
+		Retries:      r.Retries,
+		RetryBackoff: r.RetryBackoff,
+	}
+	host := r.URL
+	for _, scheme := range []string{"http", "https"} {
+		if strings.HasPrefix(host, scheme+"://") {
+			host = strings.TrimPrefix(host, scheme+"://")
+			if opts.Scheme == "" {
+				opts.Scheme = scheme
+			}
+		}
+	}
+	host = strings.TrimSuffix(host, "/")
+	if host == "" || strings.Contains(host, "/") {
+		return "", opts, fmt.Errorf("invalid registry url %q", r.URL)
+	}
+	return host, opts, opts.Valid()
+}
+
+// NewRegistries creates the controller.Registries of the options of the
+// registries of the profile
+func (p *Profile) NewRegistries() (*controller.Registries, error) {
+	options := make(map[string]model.RegistryOptions, len(p.Registries))
+	for _, r := range p.Registries {
+		host, opts, err := r.Options()
+		if err != nil {
+			return nil, err
+		}
+		options[host] = opts
+	}
+	return controller.NewRegistries(options)
+}
+
+// OptionValues returns the values of the options of the profile as given
+// on the command line, the list options having several values.
+func (p *Profile) OptionValues() map[string][]string {
+	values := make(map[string][]string)
+	for name, v := range p.Options {
+		switch v := v.(type) {
+		case nil:
+		case []interface{}:
+			for _, item := range v {
+				values[name] = append(values[name], fmt.Sprint(item))
+			}
+		default:
+			values[name] = []string{fmt.Sprint(v)}
+		}
+	}
+	return values
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+profile: prod
+profiles:
+  prod:
+    concurrency: 8
+    registries:
+      - url: https://registry.example.com:5000/
+        ca: /etc/rfp/ca.pem
+        credentials: env:PROD
+        retries: 3
+        retryBackoff: 2s
+      - url: registry.test
+        scheme: http
+        credentials: none
+    options:
+      key: /etc/rfp/key.json
+      force: true
+      trusted-keys: [a.json, b.json]
+  dev: {}
+`)
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	p, err := f.Select("")
+	if err != nil {
+		t.Fatalf("Select default: %s", err)
+	}
+	if p.Concurrency != 8 || len(p.Registries) != 2 {
+		t.Fatalf("profile = %+v", p)
+	}
+
+	host, opts, err := p.Registries[0].Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.RegistryOptions{Scheme: "https", CAFile: "/etc/rfp/ca.pem", Credentials: "env:PROD", Retries: 3, RetryBackoff: 2 * time.Second}
+	if host != "registry.example.com:5000" || opts != want {
+		t.Errorf("Options = %s, %+v, want registry.example.com:5000, %+v", host, opts, want)
+	}
+	if host, opts, _ := p.Registries[1].Options(); host != "registry.test" || opts.Scheme != "http" {
+		t.Errorf("Options = %s, %+v", host, opts)
+	}
+
+	values := p.OptionValues()
+	wantValues := map[string][]string{
+		"key":          {"/etc/rfp/key.json"},
+		"force":        {"true"},
+		"trusted-keys": {"a.json", "b.json"},
+	}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("OptionValues = %v, want %v", values, wantValues)
+	}
+
+	if p, err := f.Select("dev"); err != nil || p.Concurrency != 0 {
+		t.Errorf("Select dev = %+v, %v", p, err)
+	}
+	if _, err := f.Select("staging"); err == nil || !strings.Contains(err.Error(), "dev, prod") {
+		t.Errorf("Select unknown profile error = %v", err)
+	}
+	if p, err := (&File{}).Select(""); p != nil || err != nil {
+		t.Errorf("Select without default = %+v, %v", p, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, content string
+	}{
+		{"unknown field", "profiles:\n  prod:\n    registry: []\n"},
+		{"invalid url", "profiles:\n  prod:\n    registries:\n      - url: https://registry.example.com/path\n"},
+		{"invalid scheme", "profiles:\n  prod:\n    registries:\n      - url: registry.example.com\n        scheme: ftp\n"},
+		{"invalid credentials", "profiles:\n  prod:\n    registries:\n      - url: registry.example.com\n        credentials: vault\n"},
+		{"invalid duration", "profiles:\n  prod:\n    registries:\n      - url: registry.example.com\n        retryBackoff: soon\n"},
+		{"negative concurrency", "profiles:\n  prod:\n    concurrency: -1\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Load(writeConfig(t, test.content)); err == nil {
+				t.Error("config loaded")
+			}
+		})
+	}
+}
+
+func TestNewRegistries(t *testing.T) {
+	p := &Profile{Registries: []Registry{{URL: "http://apply.test:5000", Retries: 2}}}
+	registries, err := p.NewRegistries()
+	if err != nil {
+		t.Fatalf("NewRegistries: %s", err)
+	}
+
+	opts := registries.Options("http://apply.test:5000")
+	if opts.Scheme != "http" || opts.Retries != 2 {
+		t.Errorf("Options = %+v", opts)
+	}
+	if opts := registries.Options("other.test:5000"); opts != (model.RegistryOptions{}) {
+		t.Errorf("Options of other registry = %+v, want the default ones", opts)
+	}
+}
+
+func TestDefaultPath(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg")
+	if path := DefaultPath(); path != "/tmp/xdg/rfp/config.yaml" {
+		t.Errorf("DefaultPath = %s", path)
+	}
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// WriteDockerArchive writes the image into the tar file archivePath in the
+// format of `docker save`, tagged as name:tag for each of tags. Every layer
+// gets a directory with its v1 json, so both legacy and current docker can
+// load it, while manifest.json only lists the layers of the rootfs.
+func (ec *ExportController) WriteDockerArchive(ctx context.Context, archivePath, name string, tags []string) error {
+	log.FromContext(ctx).Debugf("ready to write docker archive %s", archivePath)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(archivePath), ".archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = ec.writeArchive(tmp, name, tags)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), archivePath); err != nil {
+		return err
+	}
+
+	log.FromContext(ctx).Debugf("finish write docker archive %s", archivePath)
+	return nil
+}
+
+func (ec *ExportController) writeArchive(w io.Writer, name string, tags []string) error {
+	tw := tar.NewWriter(w)
+
+	configDigest, err := digest.ParseDigest(ec.ConfigDigest)
+	if err != nil {
+		return err
+	}
+	manifest := model.ArchiveManifest{Config: configDigest.Hex() + ".json", Layers: []string{}}
+	if err := writeArchiveFile(tw, manifest.Config, ec.Config); err != nil {
+		return err
+	}
+
+	topID := ""
+	for i, layer := range ec.Layers {
+		var v1 struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(layer.V1Compatibility), &v1); err != nil {
+			return fmt.Errorf("error parse v1Compatibility of layer %d: %s", i, err)
+		}
+		if v1.ID == "" {
+			return fmt.Errorf("missing id in v1Compatibility of layer %d", i)
+		}
+		topID = v1.ID
+
+		if err := ec.writeArchiveLayer(tw, v1.ID, layer); err != nil {
+			return err
+		}
+		if !layer.Empty {
+			manifest.Layers = append(manifest.Layers, path.Join(v1.ID, "layer.tar"))
+		}
+	}
+
+	repositories := model.ArchiveRepositories{name: {}}
+	for _, tag := range tags {
+		manifest.RepoTags = append(manifest.RepoTags, fmt.Sprintf("%s:%s", name, tag))
+		repositories[name][tag] = topID
+	}
+
+	data, err := json.Marshal([]model.ArchiveManifest{manifest})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, model.ArchiveManifestFile, data); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(repositories); err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, model.ArchiveRepositoriesFile, data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeArchiveLayer writes the directory of layer named by its v1 id,
+// layer.tar holds the uncompressed blob, or an empty tar for empty layers.
+func (ec *ExportController) writeArchiveLayer(tw *tar.Writer, id string, layer ExportLayer) error {
+	if err := tw.WriteHeader(archiveHeader(id+"/", tar.TypeDir, 0)); err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, path.Join(id, "VERSION"), []byte(model.ArchiveLayerVersion)); err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, path.Join(id, "json"), []byte(layer.V1Compatibility)); err != nil {
+		return err
+	}
+
+	if layer.Empty {
+		empty, err := emptyTar()
+		if err != nil {
+			return err
+		}
+		return writeArchiveFile(tw, path.Join(id, "layer.tar"), empty)
+	}
+
+	dgst, err := digest.ParseDigest(layer.Digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(ec.BlobDir, dgst.Hex()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, _, err := utils.Decompress(f)
+	if err != nil {
+		return fmt.Errorf("error decompress blob %s: %s", layer.Digest, err)
+	}
+	defer r.Close()
+
+	if err := tw.WriteHeader(archiveHeader(path.Join(id, "layer.tar"), tar.TypeReg, layer.DiffSize)); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("error decompress blob %s: %s", layer.Digest, err)
+	}
+	return nil
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(archiveHeader(name, tar.TypeReg, int64(len(content)))); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// archiveHeader returns the tar header of an archive entry, the entries
+// have fixed mode and mtime so the same image gives the same archive.
+func archiveHeader(name string, typeflag byte, size int64) *tar.Header {
+	mode := int64(0644)
+	if typeflag == tar.TypeDir {
+		mode = 0755
+	}
+	return &tar.Header{
+		Name:     name,
+		Typeflag: typeflag,
+		Mode:     mode,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// emptyTar returns a tar archive without any entry
+func emptyTar() ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
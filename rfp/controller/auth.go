@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,29 +11,35 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/docker/docker/pkg/homedir"
-
 	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
 	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
 )
 
+// indexServer is the key of the Docker Hub credentials in docker config file
+const indexServer = "https://index.docker.io/v1/"
+
 type AuthController struct {
 	configDir      string
 	configFileName string
+
+	// credentials, if set, are used instead of the docker config file
+	credentials *model.AuthConfig
+
+	// registries are the options of the registries authenticated with
+	registries *Registries
 }
 
-// NewAuthController create an AuthController based on the passed dir and fileName.
-func NewAuthController(dir, fileName string) *AuthController {
+// NewAuthController create an AuthController based on the passed dir and fileName,
+// accessing the registries with their options in registries.
+func NewAuthController(dir, fileName string, registries *Registries) *AuthController {
 	ac := &AuthController{
 		configDir:      dir,
-		configFileName: fileName}
+		configFileName: fileName,
+		registries:     registries}
 
 	if dir == "" {
-		configDir := os.Getenv("DOCKER_CONFIG")
-		ac.configDir = configDir
-		if configDir == "" {
-			ac.configDir = filepath.Join(homedir.Get(), ".docker")
-		}
+		ac.configDir = utils.DockerConfigDir()
 	}
 
 	if fileName == "" {
@@ -41,26 +48,64 @@ func NewAuthController(dir, fileName string) *AuthController {
 	return ac
 }
 
-// GetAuthToken get the auth token for the specified registry and repository,
-// if auth is not need, an empty string will be returned.
-func (ac *AuthController) GetAuthToken(registry, repository string) (string, error) {
-	params, err := ac.ping(registry)
+// NewCredentialsAuthController creates an AuthController authenticating
+// with username and password instead of the docker config file.
+func NewCredentialsAuthController(username, password string, registries *Registries) *AuthController {
+	return &AuthController{
+		credentials: &model.AuthConfig{Username: username, Password: password},
+		registries:  registries}
+}
+
+// Authenticate returns the RegistryAuth of the specified registry and
+// repository: a token from the token service of the registry, or the basic
+// auth credentials if the registry has none. It is empty if auth is not needed.
+func (ac *AuthController) Authenticate(ctx context.Context, registry, repository string) (model.RegistryAuth, error) {
+	params, err := ac.ping(ctx, registry)
 	if err != nil {
-		return "", nil
+		return model.RegistryAuth{}, fmt.Errorf("error ping registry %s: %s", registry, err)
 	}
 
 	if params != nil {
-		authConfigs, err := ac.loadConfig()
+		authConfig, err := ac.authConfig(ctx, registry)
 		if err != nil {
-			return "", err
+			return model.RegistryAuth{}, err
+		}
+		if _, ok := params["Basic realm"]; ok {
+			return model.RegistryAuth{Basic: &authConfig}, nil
 		}
-		registry = ac.formatRegistry(registry)
-		authConfig := authConfigs.AuthConfigs[registry]
-		token, err := ac.authorize(repository, &authConfig, params)
-		return token, err
+		token, err := ac.authorize(ctx, repository, &authConfig, params)
+		return model.RegistryAuth{Token: token}, err
+	}
+
+	return model.RegistryAuth{}, nil
+}
+
+// authConfig returns the credentials of registry
+func (ac *AuthController) authConfig(ctx context.Context, registry string) (model.AuthConfig, error) {
+	if ac.credentials != nil {
+		return *ac.credentials, nil
+	}
+	opts := ac.registries.Options(registry)
+	if opts.Credentials == model.CredentialsNone {
+		return model.AuthConfig{}, nil
+	}
+	if prefix, ok := opts.CredentialsEnvPrefix(); ok {
+		return model.AuthConfig{
+			Username: os.Getenv(prefix + "_USERNAME"),
+			Password: os.Getenv(prefix + "_PASSWORD"),
+		}, nil
 	}
 
-	return "", nil
+	authConfigs, err := ac.loadConfig(ctx)
+	if err != nil {
+		return model.AuthConfig{}, err
+	}
+	registry = ac.formatRegistry(registry)
+	authConfig, ok := authConfigs.AuthConfigs[registry]
+	if !ok && registry == model.DefaultRegistry {
+		authConfig = authConfigs.AuthConfigs[indexServer]
+	}
+	return authConfig, nil
 }
 
 func (ac *AuthController) formatRegistry(registry string) string {
@@ -76,12 +121,12 @@ func (ac *AuthController) formatRegistry(registry string) string {
 
 // ping will connect the registry, check whether needing authorization,
 // if do not get the params for authorization, means no need for authorization.
-func (ac *AuthController) ping(registry string) (map[string]string, error) {
-	log.Debugf("ping registry : %s", registry)
+func (ac *AuthController) ping(ctx context.Context, registry string) (map[string]string, error) {
+	log.FromContext(ctx).WithField(log.FieldRegistry, ac.formatRegistry(registry)).Debugf("ping registry")
 
-	client := http.DefaultClient
+	client := ac.registries.Client()
 	url := fmt.Sprintf("%s/v2/", registry)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +134,7 @@ func (ac *AuthController) ping(registry string) (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
 	if resp.StatusCode == http.StatusUnauthorized {
 		return ac.parseAuthHeader(resp.Header), nil
 	}
@@ -107,8 +153,8 @@ func (ac *AuthController) parseValueAndParams(header string) map[string]string {
 	params := make(map[string]string)
 	msgs := strings.Split(header, ",")
 	for i := 0; i < len(msgs); i++ {
-		values := strings.Split(msgs[i], "=")
-		if len(values) > 0 {
+		values := strings.SplitN(msgs[i], "=", 2)
+		if len(values) == 2 {
 			params[values[0]] = values[1]
 		}
 	}
@@ -117,8 +163,8 @@ func (ac *AuthController) parseValueAndParams(header string) map[string]string {
 
 // loadConfig reads the configuration files in the given directory, and sets up
 // the auth config information and return values.
-func (ac *AuthController) loadConfig() (*model.ConfigFile, error) {
-	log.Debugf("load config file from %s/%s", ac.configDir, ac.configFileName)
+func (ac *AuthController) loadConfig(ctx context.Context) (*model.ConfigFile, error) {
+	log.FromContext(ctx).Debugf("load config file from %s/%s", ac.configDir, ac.configFileName)
 
 	configFile := model.ConfigFile{
 		AuthConfigs: make(map[string]model.AuthConfig),
@@ -173,36 +219,55 @@ func (ac *AuthController) decodeAuth(authStr string) (string, string, error) {
 	return arr[0], password, nil
 }
 
-func (ac *AuthController) authorize(repository string, authConfig *model.AuthConfig, params map[string]string) (string, error) {
-	log.Debugf("get token for repository: %s", repository)
+func (ac *AuthController) authorize(ctx context.Context, repository string, authConfig *model.AuthConfig, params map[string]string) (string, error) {
+	log.FromContext(ctx).WithField(log.FieldRepository, repository).Debugf("get token for repository")
 
-	client := http.DefaultClient
+	client := ac.registries.Client()
 	url := params["Bearer realm"]
+	if len(url) < 2 {
+		return "", fmt.Errorf("unsupported authentication of registry, neither bearer nor basic")
+	}
 	url = url[1 : len(url)-1]
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
 	}
 
-	service := params["service"]
 	reqParams := req.URL.Query()
-	reqParams.Add("service", service[1:len(service)-1])
+	// service is optional in the challenge
+	if service := strings.Trim(params["service"], `"`); service != "" {
+		reqParams.Add("service", service)
+	}
 	reqParams.Add("scope", "repository:"+repository+":push,pull")
 	reqParams.Add("account", authConfig.Username)
 	req.SetBasicAuth(authConfig.Username, authConfig.Password)
 	req.URL.RawQuery = reqParams.Encode()
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", nil
+		tokenFetches.Inc("error")
+		return "", fmt.Errorf("error getting token from %s: %s", url, err)
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode > 300 {
+		tokenFetches.Inc("error")
+		return "", fmt.Errorf("error when getting token from %s, status_code=%v", url, resp.StatusCode)
+	}
 	respBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", nil
+		tokenFetches.Inc("error")
+		return "", fmt.Errorf("error reading token from %s: %s", url, err)
 	}
 
 	token := model.Token{}
-	json.Unmarshal(respBytes, &token)
+	if err := json.Unmarshal(respBytes, &token); err != nil {
+		tokenFetches.Inc("error")
+		return "", fmt.Errorf("error parse token from %s: %s", url, err)
+	}
+	if token.Token == "" {
+		tokenFetches.Inc("error")
+		return "", fmt.Errorf("no token returned from %s", url)
+	}
+	tokenFetches.Inc("success")
 	return token.Token, nil
 }
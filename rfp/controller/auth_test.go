@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+)
+
+func TestAuthenticateNoAuth(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+
+	ac := NewAuthController(t.TempDir(), "", nil)
+	auth, err := ac.Authenticate(context.Background(), reg.URL(), "app")
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if !auth.IsZero() {
+		t.Errorf("auth = %+v, want empty", auth)
+	}
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.SetAuth(rfptest.AuthBearer, "alice", "secret")
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"a": "a"}))
+
+	ac := NewAuthController(rfptest.WriteDockerConfig(t, "alice", "secret", reg.Host()), "", nil)
+	auth, err := ac.Authenticate(context.Background(), reg.URL(), "app")
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if auth.Token == "" || auth.Basic != nil {
+		t.Fatalf("auth = %+v, want a bearer token", auth)
+	}
+
+	// the token is accepted by the registry
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "app", "1"), auth.Token, nil)
+	if err != nil {
+		t.Fatalf("NewManifestController with the token: %s", err)
+	}
+	if mc.Tag != "1" {
+		t.Errorf("manifest tag = %q, want 1", mc.Tag)
+	}
+}
+
+func TestAuthenticateBearerWrongPassword(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.SetAuth(rfptest.AuthBearer, "alice", "secret")
+
+	ac := NewAuthController(rfptest.WriteDockerConfig(t, "alice", "wrong", reg.Host()), "", nil)
+	if _, err := ac.Authenticate(context.Background(), reg.URL(), "app"); err == nil {
+		t.Fatal("Authenticate with a wrong password succeeded")
+	}
+}
+
+func TestAuthenticateBasic(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.SetAuth(rfptest.AuthBasic, "bob", "pass")
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"a": "a"}))
+
+	ac := NewAuthController(rfptest.WriteDockerConfig(t, "bob", "pass", reg.Host()), "", nil)
+	auth, err := ac.Authenticate(context.Background(), reg.URL(), "app")
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if auth.Token != "" || auth.Basic == nil || auth.Basic.Username != "bob" || auth.Basic.Password != "pass" {
+		t.Fatalf("auth = %+v, want the basic auth credentials", auth)
+	}
+
+	loc := model.NewImageLocation(reg.URL(), "app", "1")
+	rs, err := NewRegistryStore(context.Background(), loc, auth, nil)
+	if err != nil {
+		t.Fatalf("NewRegistryStore: %s", err)
+	}
+	if _, err := NewStoreManifestController(context.Background(), rs.Manifests(), loc); err != nil {
+		t.Fatalf("NewStoreManifestController with the credentials: %s", err)
+	}
+}
+
+// newChallengeServer starts a registry answering /v2/ with challenge, in
+// which %s is the URL of its /token, and /token with token, in which %s
+// is the service requested.
+func newChallengeServer(challenge, token string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			io.WriteString(w, strings.Replace(token, "%s", req.URL.Query().Get("service"), 1))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", strings.Replace(challenge, "%s", server.URL+"/token", 1))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	return server
+}
+
+func TestAuthenticateChallenges(t *testing.T) {
+	for _, test := range []struct {
+		challenge, want string
+	}{
+		{`Bearer realm="%s",service="registry"`, "service=registry"},
+		{`Bearer realm="%s"`, "service="},
+		{`Bearer realm="%s",error,service="registry"`, "service=registry"},
+		{`Bearer realm="%s",service="registry",scope="repository:app:pull",error="insufficient_scope"`, "service=registry"},
+		{`Bearer realm="%s",service="a=b"`, "service=a=b"},
+	} {
+		t.Run(test.challenge, func(t *testing.T) {
+			server := newChallengeServer(test.challenge, `{"token":"service=%s"}`)
+			defer server.Close()
+
+			auth, err := NewCredentialsAuthController("alice", "secret", nil).Authenticate(context.Background(), server.URL, "app")
+			if err != nil {
+				t.Fatalf("Authenticate: %s", err)
+			}
+			if auth.Token != test.want {
+				t.Errorf("token = %q, want %q", auth.Token, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, test := range []struct {
+		name, challenge, token, want string
+	}{
+		{"no token", `Bearer realm="%s",service="registry"`, `{}`, "no token returned from"},
+		{"invalid token", `Bearer realm="%s",service="registry"`, `not json`, "error parse token from"},
+		{"unreachable token service", `Bearer realm="` + closed.URL + `/token",service="registry"`, `{"token":"t"}`,
+			"error getting token from " + closed.URL},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := newChallengeServer(test.challenge, test.token)
+			defer server.Close()
+
+			_, err := NewCredentialsAuthController("alice", "secret", nil).Authenticate(context.Background(), server.URL, "app")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want containing %q", err, test.want)
+			}
+		})
+	}
+
+	// the registry cannot be reached rather than needing no auth
+	_, err := NewAuthController(t.TempDir(), "", nil).Authenticate(context.Background(), closed.URL, "app")
+	if want := "error ping registry " + closed.URL; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want containing %q", err, want)
+	}
+}
+
+func TestRegistryStoreSendsTokensAsBearer(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.SetAuth(rfptest.AuthBasic, "bob", "pass")
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"a": "a"}))
+
+	// a token given by the caller is never taken for basic auth credentials,
+	// whatever it looks like
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pass"))
+	if _, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "app", "1"), basic, nil); err == nil {
+		t.Fatal("token is sent as basic auth credentials")
+	}
+	for _, req := range reg.Requests() {
+		if req.Status != http.StatusUnauthorized {
+			t.Errorf("%s %s = %d, want refused", req.Method, req.Path, req.Status)
+		}
+	}
+}
@@ -1,141 +1,223 @@
 package controller
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/http"
-	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
 
 	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
 	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
 )
 
-// BlobController can download the blob from source location with sourceToken,
-// then upload it to the target locaiton with targetToken.
+// BlobController can download the blob from source store,
+// then upload it to the target store.
 type BlobController struct {
-	source model.ImageLocation
-	target model.ImageLocation
-
-	sourceToken string
-	targetToken string
+	source store.BlobStore
+	target store.BlobStore
 
 	BlobSum string
 	Content []byte
+
+	// Size is the size of the blob, known after Transfer
+	Size int64
+
+	// DiffID is the digest of the uncompressed blob, known after Recompress
+	DiffID string
+
+	// Download, if set, gets the content of the blob to copy instead of
+	// Fetch, so the downloads can be shared with other BlobControllers
+	Download func(ctx context.Context) ([]byte, error)
+
+	// Progress, if set, is notified of the bytes downloaded and uploaded
+	Progress Progress
+
+	// RateLimit, if set, limits the bandwidth of the downloads and uploads
+	RateLimit *RateLimit
 }
 
-// NewBlobController will get the source an
-func NewBlobController(s, t model.ImageLocation, b string, sJWT, tJWT string) (*BlobController, error) {
-	bc := &BlobController{source: s, target: t, BlobSum: b}
-
-	ac := NewAuthController("", "")
-	if len(sJWT) > 0 {
-		bc.sourceToken = sJWT
-	} else {
-		sToken, err := ac.GetAuthToken(bc.source.Registry, bc.source.Repository)
-		if err != nil {
-			return bc, err
-		}
-		bc.sourceToken = sToken
+// NewBlobController creates a BlobController transfering the blob b from
+// the repository of s to the one of t, both in registry, accessed with their
+// options in registries.
+func NewBlobController(ctx context.Context, s, t model.ImageLocation, b string, sJWT, tJWT string, registries *Registries) (*BlobController, error) {
+	sStore, err := NewRegistryStore(ctx, s, model.RegistryAuth{Token: sJWT}, registries)
+	if err != nil {
+		return nil, err
+	}
+	tStore, err := NewRegistryStore(ctx, t, model.RegistryAuth{Token: tJWT}, registries)
+	if err != nil {
+		return nil, err
 	}
+	return NewStoreBlobController(sStore.Blobs(), tStore.Blobs(), b), nil
+}
 
-	if len(tJWT) > 0 {
-		bc.targetToken = tJWT
-	} else {
-		tToken, err := ac.GetAuthToken(bc.target.Registry, bc.target.Repository)
-		if err != nil {
-			return bc, err
+// NewStoreBlobController creates a BlobController transfering the blob b
+// between any stores. s may be nil if the blob is only pushed from Content,
+// and t may be nil if the blob is only read.
+func NewStoreBlobController(s, t store.BlobStore, b string) *BlobController {
+	return &BlobController{source: s, target: t, BlobSum: b}
+}
+
+// Transfer makes the blob available in target store, it is skipped
+// if already there, mounted if the target store can do so from source,
+// or downloaded from source and uploaded to target otherwise.
+func (bc *BlobController) Transfer(ctx context.Context) (model.TransferMode, error) {
+	size, exists, err := bc.target.Stat(ctx, bc.BlobSum)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		bc.Size = size
+		countTransfer(model.TransferSkipped, 0)
+		return model.TransferSkipped, nil
+	}
+
+	mounted, err := bc.target.Mount(ctx, bc.BlobSum, bc.source)
+	if err != nil {
+		return "", err
+	}
+	if mounted {
+		if bc.Size, _, err = bc.target.Stat(ctx, bc.BlobSum); err != nil {
+			return "", err
 		}
-		bc.targetToken = tToken
+		countTransfer(model.TransferMounted, 0)
+		return model.TransferMounted, nil
 	}
 
-	return bc, nil
+	if err := bc.download(ctx); err != nil {
+		return "", err
+	}
+	if err := bc.target.Put(bc.withStreams(ctx, ProgressUpload), bc.BlobSum, bytes.NewReader(bc.Content)); err != nil {
+		return "", err
+	}
+	bc.reportDone(ProgressUpload, int64(len(bc.Content)))
+	countTransfer(model.TransferCopied, len(bc.Content))
+	return model.TransferCopied, nil
 }
 
-// Transfer download an blob from source repository,
-// and upload it to target repository
-func (bc *BlobController) Transfer() error {
-	if err := bc.download(); err != nil {
-		return err
+// Push uploads Content into target store,
+// it is skipped if the blob is already there.
+func (bc *BlobController) Push(ctx context.Context) (model.TransferMode, error) {
+	size, exists, err := bc.target.Stat(ctx, bc.BlobSum)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		bc.Size = size
+		countTransfer(model.TransferSkipped, 0)
+		return model.TransferSkipped, nil
 	}
 
-	if err := bc.upload(); err != nil {
-		return err
+	if err := bc.target.Put(bc.withStreams(ctx, ProgressUpload), bc.BlobSum, bytes.NewReader(bc.Content)); err != nil {
+		return "", err
 	}
-	return nil
+	bc.reportDone(ProgressUpload, int64(len(bc.Content)))
+	bc.Size = int64(len(bc.Content))
+	countTransfer(model.TransferCopied, len(bc.Content))
+	return model.TransferCopied, nil
 }
 
-func (bc *BlobController) download() error {
-	log.Debugf("ready to download blob content")
+// Recompress converts the blob read from source store, or Content if it is
+// already loaded, to the compression rc. BlobSum, Content and Size become
+// the ones of the converted blob, whose uncompressed content and so DiffID
+// are the same as the original one. A blob already in the compression is
+// kept as is if rc has no level.
+func (bc *BlobController) Recompress(ctx context.Context, rc model.Recompression) error {
+	if bc.Content == nil {
+		if err := bc.download(ctx); err != nil {
+			return err
+		}
+	}
+	logger := log.FromContext(ctx).WithField(log.FieldDigest, bc.BlobSum)
+	logger.Debugf("ready to recompress blob as %s", rc)
 
-	getBlobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", bc.source.Registry,
-		bc.source.Repository, bc.BlobSum)
-	req, err := http.NewRequest("GET", getBlobURL, nil)
+	r, compression, err := utils.Decompress(bytes.NewReader(bc.Content))
 	if err != nil {
-		return err
+		return fmt.Errorf("error decompress blob %s: %s", bc.BlobSum, err)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if compression == rc.Compression && rc.Level == 0 {
+		if _, err := io.Copy(h, r); err != nil {
+			return fmt.Errorf("error decompress blob %s: %s", bc.BlobSum, err)
+		}
+		bc.DiffID = digest.NewDigest(digest.SHA256, h).String()
+		bc.Size = int64(len(bc.Content))
+		logger.Debugf("blob is already %s compressed", compression)
+		return nil
 	}
-	bc.addAuthHeader(req, true)
 
-	resp, err := http.DefaultClient.Do(req)
+	var buf bytes.Buffer
+	w, err := utils.Compress(&buf, rc)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if bc.Content, err = ioutil.ReadAll(resp.Body); err != nil {
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return fmt.Errorf("error recompress blob %s: %s", bc.BlobSum, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error recompress blob %s: %s", bc.BlobSum, err)
+	}
+
+	dgst, err := digest.FromBytes(buf.Bytes())
+	if err != nil {
 		return err
 	}
+	logger.Debugf("finish recompress blob from %s as %s", compression, dgst)
 
-	log.Debugf("finish download blob content from %s", getBlobURL)
+	bc.BlobSum = dgst.String()
+	bc.Content = buf.Bytes()
+	bc.Size = int64(buf.Len())
+	bc.DiffID = digest.NewDigest(digest.SHA256, h).String()
 	return nil
 }
 
-func (bc *BlobController) upload() error {
-	log.Debugf("ready to upload blob content")
-	client := http.DefaultClient
-
-	// initial upload
-	initURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", bc.target.Registry,
-		bc.target.Repository)
-	initReq, err := http.NewRequest("POST", initURL, nil)
-	if err != nil {
-		return err
+func (bc *BlobController) download(ctx context.Context) error {
+	fetch := bc.Fetch
+	if bc.Download != nil {
+		fetch = bc.Download
 	}
-	bc.addAuthHeader(initReq, false)
-	initResp, err := client.Do(initReq)
+	content, err := fetch(ctx)
 	if err != nil {
 		return err
 	}
-	if initResp.StatusCode > 300 {
-		return fmt.Errorf("error when initial upload of blob: %s, status_code=%v",
-			initURL, initResp.StatusCode)
-	}
-	location := initResp.Header.Get("Location")
+	bc.Content = content
+	bc.Size = int64(len(content))
+	return nil
+}
 
-	// upload blob
-	uploadBlobURL := fmt.Sprintf("%s&digest=%s", location, bc.BlobSum)
-	uploadBody := ioutil.NopCloser(strings.NewReader(string(bc.Content)))
-	uploadReq, err := http.NewRequest("PUT", uploadBlobURL, uploadBody)
+// Fetch reads the whole content of the blob from source store
+func (bc *BlobController) Fetch(ctx context.Context) ([]byte, error) {
+	start := time.Now()
+	logger := log.FromContext(ctx).WithField(log.FieldDigest, bc.BlobSum)
+	logger.Debugf("ready to download blob content")
+
+	body, err := bc.Open(bc.withStreams(ctx, ProgressDownload))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	bc.addAuthHeader(uploadReq, false)
-	uploadReq.Header.Set("Content-Length", string(len(bc.Content)))
-	uploadResp, err := client.Do(uploadReq)
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
 	if err != nil {
-		return err
-	}
-	if uploadResp.StatusCode > 300 {
-		return fmt.Errorf("error when initial upload of blob: %s, status_code=%v",
-			uploadBlobURL, uploadResp.StatusCode)
+		return nil, err
 	}
+	blobBytes.Add(float64(len(content)), "download")
+	bc.reportDone(ProgressDownload, int64(len(content)))
 
-	log.Debugf("finish upload blob content to %s", initURL)
-	return nil
+	logger.WithField(log.FieldDuration, log.Duration(time.Since(start))).Debugf("finish download blob content of %d bytes", len(content))
+	return content, nil
 }
 
-func (bc *BlobController) addAuthHeader(req *http.Request, isSource bool) {
-	if isSource {
-		req.Header.Set("Authorization", "Bearer "+bc.sourceToken)
-	} else {
-		req.Header.Set("Authorization", "Bearer "+bc.targetToken)
-	}
+// Open opens the content of the blob in source store for reading,
+// the caller must close it.
+func (bc *BlobController) Open(ctx context.Context) (io.ReadCloser, error) {
+	return bc.source.Open(ctx, bc.BlobSum)
 }
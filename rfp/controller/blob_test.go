@@ -0,0 +1,326 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+)
+
+func newTestBlobController(t *testing.T, s, t2 *rfptest.Registry, sRepo, tRepo, blobSum string) *BlobController {
+	bc, err := NewBlobController(context.Background(),
+		model.NewImageLocation(s.URL(), sRepo, "1"), model.NewImageLocation(t2.URL(), tRepo, "1"), blobSum, "", "", nil)
+	if err != nil {
+		t.Fatalf("NewBlobController: %s", err)
+	}
+	return bc
+}
+
+func TestBlobTransferCopied(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	layer := rfptest.Layer(map[string]string{"app": "binary"})
+	blobSum := src.PutBlob("app", layer)
+
+	bc := newTestBlobController(t, src, target, "app", "base", blobSum)
+	mode, err := bc.Transfer(context.Background())
+	if err != nil {
+		t.Fatalf("Transfer: %s", err)
+	}
+	if mode != model.TransferCopied {
+		t.Errorf("mode = %s, want %s", mode, model.TransferCopied)
+	}
+	if bc.Size != int64(len(layer)) {
+		t.Errorf("size = %d, want %d", bc.Size, len(layer))
+	}
+	if content, ok := target.Blob("base", blobSum); !ok || !bytes.Equal(content, layer) {
+		t.Error("blob is not copied into the target repository")
+	}
+}
+
+// recordedProgress records the updates of the transfers
+type recordedProgress struct {
+	mu      sync.Mutex
+	updates map[string][][2]int64
+}
+
+func (p *recordedProgress) Update(dgst, direction string, done, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates[direction] = append(p.updates[direction], [2]int64{done, total})
+}
+
+func TestBlobTransferProgress(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	content := bytes.Repeat([]byte("layer content "), 1<<16)
+	size := int64(len(content))
+	blobSum := src.PutBlob("app", content)
+
+	progress := &recordedProgress{updates: make(map[string][][2]int64)}
+	bc := newTestBlobController(t, src, target, "app", "base", blobSum)
+	bc.Progress = progress
+	if _, err := bc.Transfer(context.Background()); err != nil {
+		t.Fatalf("Transfer: %s", err)
+	}
+
+	for _, direction := range []string{ProgressDownload, ProgressUpload} {
+		updates := progress.updates[direction]
+		if len(updates) < 2 {
+			t.Fatalf("%d %s updates, want the ones of every read", len(updates), direction)
+		}
+		var last int64
+		for _, u := range updates {
+			if u[0] < last || u[1] != size {
+				t.Errorf("%s update %d/%d after %d, want increasing up to %d", direction, u[0], u[1], last, size)
+			}
+			last = u[0]
+		}
+		if last != size {
+			t.Errorf("%s ends at %d, want %d", direction, last, size)
+		}
+	}
+}
+
+func TestBlobTransferRateLimit(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	content := bytes.Repeat([]byte("layer content "), 1<<14)
+	blobSum := src.PutBlob("app", content)
+
+	// the download and the upload each go at 512KB/s past the first 52KB
+	rate := int64(512 << 10)
+	min := 2 * time.Duration(float64(int64(len(content))-rate/10)/float64(rate)*float64(time.Second))
+	bc := newTestBlobController(t, src, target, "app", "base", blobSum)
+	bc.RateLimit = NewRateLimit(0, rate)
+	start := time.Now()
+	if _, err := bc.Transfer(context.Background()); err != nil {
+		t.Fatalf("Transfer: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < min {
+		t.Errorf("transfer took %s, want at least %s", elapsed, min)
+	}
+	if got, ok := target.Blob("base", blobSum); !ok || !bytes.Equal(got, content) {
+		t.Error("blob is not transferred whole")
+	}
+
+	// a transfer too slow for its context is aborted
+	bc = newTestBlobController(t, src, target, "app", "slow", blobSum)
+	bc.RateLimit = NewRateLimit(1<<10, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := bc.Transfer(ctx); err == nil {
+		t.Error("Transfer succeeded beyond the deadline")
+	}
+}
+
+func TestBlobTransferMounted(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	blobSum := reg.PutBlob("app", rfptest.Layer(map[string]string{"app": "binary"}))
+
+	bc := newTestBlobController(t, reg, reg, "app", "base", blobSum)
+	mode, err := bc.Transfer(context.Background())
+	if err != nil {
+		t.Fatalf("Transfer: %s", err)
+	}
+	if mode != model.TransferMounted {
+		t.Errorf("mode = %s, want %s", mode, model.TransferMounted)
+	}
+	if _, ok := reg.Blob("base", blobSum); !ok {
+		t.Error("blob is not mounted into the target repository")
+	}
+	for _, req := range reg.Requests() {
+		if req.Method == "GET" && strings.Contains(req.Path, "/blobs/") {
+			t.Errorf("blob is downloaded by %s %s while mounting", req.Method, req.Path)
+		}
+	}
+}
+
+func TestBlobTransferSkipped(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	layer := rfptest.Layer(map[string]string{"app": "binary"})
+	blobSum := src.PutBlob("app", layer)
+	target.PutBlob("base", layer)
+
+	bc := newTestBlobController(t, src, target, "app", "base", blobSum)
+	mode, err := bc.Transfer(context.Background())
+	if err != nil {
+		t.Fatalf("Transfer: %s", err)
+	}
+	if mode != model.TransferSkipped {
+		t.Errorf("mode = %s, want %s", mode, model.TransferSkipped)
+	}
+}
+
+func TestBlobTransferUploadFailure(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	blobSum := src.PutBlob("app", rfptest.Layer(map[string]string{"app": "binary"}))
+	target.Fail("PUT", "/blobs/uploads/", http.StatusInternalServerError, 1)
+
+	bc := newTestBlobController(t, src, target, "app", "base", blobSum)
+	if _, err := bc.Transfer(context.Background()); err == nil {
+		t.Fatal("Transfer succeeded while the upload fails")
+	}
+	if _, ok := target.Blob("base", blobSum); ok {
+		t.Error("blob exists in target repository after the failed upload")
+	}
+
+	// the upload session is cancelled
+	cancelled := false
+	for _, req := range target.Requests() {
+		if req.Method == "DELETE" && strings.Contains(req.Path, "/blobs/uploads/") {
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		t.Error("upload session is not cancelled after the failed upload")
+	}
+}
+
+func TestBlobTransferBetweenStores(t *testing.T) {
+	src, target := store.NewMemory(), store.NewMemory()
+	content := rfptest.Layer(map[string]string{"app": "binary"})
+	dgst, _ := digest.FromBytes(content)
+	if err := src.Blobs().Put(context.Background(), dgst.String(), bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	bc := NewStoreBlobController(src.Blobs(), target.Blobs(), dgst.String())
+	mode, err := bc.Transfer(context.Background())
+	if err != nil {
+		t.Fatalf("Transfer: %s", err)
+	}
+	if mode != model.TransferMounted {
+		t.Errorf("mode = %s, want %s", mode, model.TransferMounted)
+	}
+	if _, exists, _ := target.Blobs().Stat(context.Background(), dgst.String()); !exists {
+		t.Error("blob is not in target store")
+	}
+}
+
+// diffID returns the digest of the uncompressed content of blob
+func diffID(t *testing.T, blob []byte) string {
+	r, _, err := utils.Decompress(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		t.Fatal(err)
+	}
+	return digest.NewDigest(digest.SHA256, h).String()
+}
+
+func TestBlobRecompress(t *testing.T) {
+	layer := rfptest.Layer(map[string]string{"app": strings.Repeat("binary", 100)})
+	gz, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		blob []byte
+		rc   model.Recompression
+		same bool
+	}{
+		{"gzip to zstd", layer, model.Recompression{Compression: model.CompressionZstd}, false},
+		{"gzip level", layer, model.Recompression{Compression: model.CompressionGzip, Level: 1}, false},
+		{"plain to gzip", plain, model.Recompression{Compression: model.CompressionGzip}, false},
+		{"gzip kept", layer, model.Recompression{Compression: model.CompressionGzip}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			target := store.NewMemory()
+			blobSum, _ := digest.FromBytes(test.blob)
+			bc := NewStoreBlobController(nil, target.Blobs(), blobSum.String())
+			bc.Content = test.blob
+
+			if err := bc.Recompress(context.Background(), test.rc); err != nil {
+				t.Fatalf("Recompress: %s", err)
+			}
+			if (bc.BlobSum == blobSum.String()) != test.same {
+				t.Errorf("blob sum changed = %v, want %v", bc.BlobSum != blobSum.String(), !test.same)
+			}
+			if want := diffID(t, test.blob); bc.DiffID != want {
+				t.Errorf("diff_id = %s, want %s", bc.DiffID, want)
+			}
+			if got := diffID(t, bc.Content); got != bc.DiffID {
+				t.Errorf("diff_id of recompressed blob = %s, want %s", got, bc.DiffID)
+			}
+
+			_, compression, _ := utils.Decompress(bytes.NewReader(bc.Content))
+			if compression != test.rc.Compression {
+				t.Errorf("compression = %s, want %s", compression, test.rc.Compression)
+			}
+
+			if _, err := bc.Push(context.Background()); err != nil {
+				t.Fatalf("Push: %s", err)
+			}
+			if _, exists, _ := target.Blobs().Stat(context.Background(), bc.BlobSum); !exists {
+				t.Error("recompressed blob is not pushed")
+			}
+		})
+	}
+}
+
+func TestBlobTransferMetrics(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	layer := rfptest.Layer(map[string]string{"app": "metrics"})
+	blobSum := src.PutBlob("app", layer)
+
+	copied, skipped := blobTransfers.Value("copied"), blobTransfers.Value("skipped")
+	uploaded, downloaded := blobBytes.Value("upload"), blobBytes.Value("download")
+	headOK := registryRequests.Value("HEAD", "200")
+
+	for i := 0; i < 2; i++ {
+		bc := newTestBlobController(t, src, target, "app", "base", blobSum)
+		if _, err := bc.Transfer(context.Background()); err != nil {
+			t.Fatalf("Transfer: %s", err)
+		}
+	}
+
+	if d := blobTransfers.Value("copied") - copied; d != 1 {
+		t.Errorf("%v blobs counted as copied, want 1", d)
+	}
+	if d := blobTransfers.Value("skipped") - skipped; d != 1 {
+		t.Errorf("%v blobs counted as skipped, want 1", d)
+	}
+	if d := blobBytes.Value("upload") - uploaded; d != float64(len(layer)) {
+		t.Errorf("%v bytes counted as uploaded, want %d", d, len(layer))
+	}
+	if d := blobBytes.Value("download") - downloaded; d != float64(len(layer)) {
+		t.Errorf("%v bytes counted as downloaded, want %d", d, len(layer))
+	}
+	if d := registryRequests.Value("HEAD", "200") - headOK; d < 1 {
+		t.Errorf("%v HEAD requests counted with status 200", d)
+	}
+}
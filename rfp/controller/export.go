@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// BlobOpener opens the content of the blob blobSum for reading
+type BlobOpener func(ctx context.Context, blobSum string) (io.ReadCloser, error)
+
+// ExportLayer is a layer of an exported image, from the bottom one
+type ExportLayer struct {
+	model.Descriptor
+
+	// DiffID is the digest of the uncompressed layer
+	DiffID string
+
+	// DiffSize is the size of the uncompressed layer
+	DiffSize int64
+
+	// V1Compatibility is the v1 image json of the layer in schema1 manifest
+	V1Compatibility string
+
+	// Empty layers are kept in history only, they are not part of the rootfs
+	Empty bool
+}
+
+// ExportController collects the layers of an image and converts its schema1
+// manifest into an image config and OCI manifest, so the image can be written
+// out as files instead of being pushed into a registry.
+type ExportController struct {
+	manifest model.Manifest
+	open     BlobOpener
+
+	// BlobDir holds the content of the blobs, named by their hex digest
+	BlobDir string
+
+	Layers []ExportLayer
+
+	Config         []byte
+	ConfigDigest   string
+	OCIManifest    model.OCIManifest
+	ManifestRaw    []byte
+	ManifestDigest string
+}
+
+func NewExportController(m model.Manifest, open BlobOpener, blobDir string) *ExportController {
+	return &ExportController{manifest: m, open: open, BlobDir: blobDir}
+}
+
+// v1Image holds the fields of v1Compatibility used by the conversion
+type v1Image struct {
+	Created         time.Time       `json:"created"`
+	Author          string          `json:"author"`
+	Comment         string          `json:"comment"`
+	Architecture    string          `json:"architecture"`
+	OS              string          `json:"os"`
+	Config          json.RawMessage `json:"config"`
+	ThrowAway       bool            `json:"throwaway"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+// Load fetches the layers of the image into BlobDir and converts the manifest.
+func (ec *ExportController) Load(ctx context.Context) error {
+	log.FromContext(ctx).Debugf("ready to export image %s:%s", ec.manifest.Name, ec.manifest.Tag)
+
+	if err := os.MkdirAll(ec.BlobDir, 0755); err != nil {
+		return err
+	}
+
+	m := ec.manifest
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return fmt.Errorf("invalid manifest of %s: %d layers with %d history entries",
+			m.Name, len(m.FSLayers), len(m.History))
+	}
+
+	config := model.ImageConfig{RootFS: model.RootFS{Type: "layers"}}
+	var top v1Image
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		var v1 v1Image
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &v1); err != nil {
+			return fmt.Errorf("error parse v1Compatibility of layer %d: %s", i, err)
+		}
+		top = v1
+
+		layer := ExportLayer{V1Compatibility: m.History[i].V1Compatibility, Empty: v1.ThrowAway}
+		history := model.ImageHistory{
+			Created:    timeOrNil(v1.Created),
+			CreatedBy:  strings.Join(v1.ContainerConfig.Cmd, " "),
+			Author:     v1.Author,
+			Comment:    v1.Comment,
+			EmptyLayer: v1.ThrowAway,
+		}
+		config.History = append(config.History, history)
+
+		if !layer.Empty {
+			if err := ec.fetch(ctx, m.FSLayers[i].BlobSum.String(), &layer); err != nil {
+				return err
+			}
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+		}
+		ec.Layers = append(ec.Layers, layer)
+	}
+
+	config.Created = timeOrNil(top.Created)
+	config.Author = top.Author
+	config.Architecture = top.Architecture
+	if config.Architecture == "" {
+		config.Architecture = m.Architecture
+	}
+	config.OS = top.OS
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	config.Config = top.Config
+
+	return ec.convert(config)
+}
+
+// fetch stores the blob into BlobDir, calculating its diff_id.
+func (ec *ExportController) fetch(ctx context.Context, blobSum string, layer *ExportLayer) error {
+	dgst, err := digest.ParseDigest(blobSum)
+	if err != nil {
+		return err
+	}
+	if dgst.Algorithm() != digest.SHA256 {
+		return fmt.Errorf("unsupported digest %s, only sha256 blobs can be exported", blobSum)
+	}
+
+	path := filepath.Join(ec.BlobDir, dgst.Hex())
+	if _, err := os.Stat(path); err != nil {
+		if err := ec.download(ctx, dgst, path); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r, compression, err := utils.Decompress(f)
+	if err != nil {
+		return fmt.Errorf("error decompress blob %s: %s", blobSum, err)
+	}
+	defer r.Close()
+	switch compression {
+	case model.CompressionGzip:
+		layer.MediaType = model.MediaTypeOCILayerGzip
+	case model.CompressionZstd:
+		layer.MediaType = model.MediaTypeOCILayerZstd
+	default:
+		layer.MediaType = model.MediaTypeOCILayer
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return fmt.Errorf("error decompress blob %s: %s", blobSum, err)
+	}
+	layer.DiffID = digest.NewDigest(digest.SHA256, h).String()
+	layer.DiffSize = n
+	layer.Digest = blobSum
+	layer.Size = info.Size()
+	return nil
+}
+
+// download writes the blob into path, checking its digest.
+func (ec *ExportController) download(ctx context.Context, dgst digest.Digest, path string) error {
+	log.FromContext(ctx).WithField(log.FieldDigest, dgst.String()).Debugf("ready to download blob")
+
+	body, err := ec.open(ctx, dgst.String())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tmp, err := ioutil.TempFile(ec.BlobDir, ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error download blob %s: %s", dgst, err)
+	}
+	if actual := digest.NewDigest(digest.SHA256, h); actual != dgst {
+		return fmt.Errorf("blob %s has digest %s", dgst, actual)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// convert builds the config and OCI manifest of the image.
+func (ec *ExportController) convert(config model.ImageConfig) error {
+	var err error
+	if ec.Config, err = json.Marshal(config); err != nil {
+		return err
+	}
+	configDigest, err := digest.FromBytes(ec.Config)
+	if err != nil {
+		return err
+	}
+	ec.ConfigDigest = configDigest.String()
+
+	ec.OCIManifest = model.OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     model.MediaTypeOCIManifest,
+		Config: model.Descriptor{
+			MediaType: model.MediaTypeOCIConfig,
+			Digest:    ec.ConfigDigest,
+			Size:      int64(len(ec.Config)),
+		},
+		Layers: []model.Descriptor{},
+	}
+	for _, layer := range ec.Layers {
+		if !layer.Empty {
+			ec.OCIManifest.Layers = append(ec.OCIManifest.Layers, layer.Descriptor)
+		}
+	}
+
+	if ec.ManifestRaw, err = json.Marshal(ec.OCIManifest); err != nil {
+		return err
+	}
+	manifestDigest, err := digest.FromBytes(ec.ManifestRaw)
+	if err != nil {
+		return err
+	}
+	ec.ManifestDigest = manifestDigest.String()
+	return nil
+}
+
+// WriteOCILayout writes the image into the OCI image layout dir, tagged as
+// each of tags. Images already in dir are kept unless they have the same tag.
+// The blobs are expected to be loaded into the blobs directory of dir.
+func (ec *ExportController) WriteOCILayout(ctx context.Context, dir string, tags []string) error {
+	log.FromContext(ctx).Debugf("ready to write OCI image layout %s", dir)
+
+	blobDir := filepath.Join(dir, "blobs", string(digest.SHA256))
+	if filepath.Clean(blobDir) != filepath.Clean(ec.BlobDir) {
+		return fmt.Errorf("blobs are loaded into %s instead of %s", ec.BlobDir, blobDir)
+	}
+
+	layout := store.NewOCILayout(dir)
+	if err := layout.Blobs().Put(ctx, ec.ConfigDigest, bytes.NewReader(ec.Config)); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := layout.Manifests().Put(ctx, tag, ec.ManifestRaw, model.MediaTypeOCIManifest); err != nil {
+			return err
+		}
+	}
+
+	log.FromContext(ctx).Debugf("finish write OCI image layout %s", dir)
+	return nil
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
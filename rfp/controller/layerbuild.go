@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// LayerBuildController builds a new layer from local files, presenting it
+// as the only layer of a schema1 manifest so it can be overlaid like the top
+// layer of an image in registry.
+type LayerBuildController struct {
+	layer model.LocalLayer
+
+	// Manifest is the schema1 manifest holding the new layer
+	Manifest model.Manifest
+
+	// Blob is the gzip compressed layer tar, BlobSum and DiffID are
+	// the digests of it and of the uncompressed tar
+	Blob    []byte
+	BlobSum string
+	DiffID  string
+}
+
+func NewLayerBuildController(layer model.LocalLayer) *LayerBuildController {
+	return &LayerBuildController{layer: layer}
+}
+
+// Load builds the layer and its manifest. The layer has no config of its
+// own, the overlaid image keeps the config of the target image.
+func (lb *LayerBuildController) Load(ctx context.Context) error {
+	log.FromContext(ctx).Debugf("ready to build layer from %s", lb.layer.Path)
+
+	var buf bytes.Buffer
+	diffID, err := utils.BuildLayer(&buf, lb.layer.Path, lb.layer.Removals)
+	if err != nil {
+		return fmt.Errorf("error build layer from %s: %s", lb.layer.Path, err)
+	}
+	lb.Blob = buf.Bytes()
+	blobSum, err := digest.FromBytes(lb.Blob)
+	if err != nil {
+		return err
+	}
+	lb.BlobSum = blobSum.String()
+	lb.DiffID = diffID.String()
+
+	created := time.Now().UTC()
+	v1Compatibility, err := json.Marshal(v1Layer{
+		ID:      utils.GenerateRandomID(),
+		Created: &created,
+		Comment: fmt.Sprintf("rfp add %s", diffID),
+	})
+	if err != nil {
+		return err
+	}
+
+	lb.Manifest = model.Manifest{Manifest: manifest.Manifest{
+		Versioned: manifest.Versioned{SchemaVersion: 1},
+		Name:      lb.layer.Path,
+		FSLayers:  []manifest.FSLayer{{BlobSum: blobSum}},
+		History:   []manifest.History{{V1Compatibility: string(v1Compatibility)}},
+	}}
+
+	log.FromContext(ctx).WithField(log.FieldDigest, lb.BlobSum).Debugf("finish build layer of %d bytes", len(lb.Blob))
+	return nil
+}
+
+// Open opens the content of the built layer for reading.
+func (lb *LayerBuildController) Open(ctx context.Context, blobSum string) (io.ReadCloser, error) {
+	if blobSum != lb.BlobSum {
+		return nil, fmt.Errorf("blob %s not found in %s", blobSum, lb.layer)
+	}
+	return ioutil.NopCloser(bytes.NewReader(lb.Blob)), nil
+}
@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// layerFile is a file of the layers built by the tests
+type layerFile struct {
+	name, content string
+	mode          os.FileMode
+}
+
+var layerFiles = []layerFile{
+	{"etc/", "", 0755},
+	{"etc/app.conf", "port: 80", 0644},
+	{"usr/", "", 0755},
+	{"usr/bin/", "", 0755},
+	{"usr/bin/app", "app", 0755},
+	{"usr/bin/tool", "tool", 0700},
+}
+
+// writeLayerDir writes files into a new directory in the order given,
+// with mtime and, when run as root, owner uid.
+func writeLayerDir(t *testing.T, files []layerFile, mtime time.Time, uid int) string {
+	dir := t.TempDir()
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f.name))
+		var err error
+		if strings.HasSuffix(f.name, "/") {
+			err = os.MkdirAll(p, f.mode)
+		} else {
+			if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+				err = ioutil.WriteFile(p, []byte(f.content), f.mode)
+			}
+		}
+		if err == nil {
+			err = os.Chmod(p, f.mode)
+		}
+		if err == nil && os.Geteuid() == 0 {
+			err = os.Lchown(p, uid, uid)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the mtimes of the directories change while their files are written
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(files[i].name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// writeLayerTar writes files into a new tar file in the order given,
+// with mtime and owner uid.
+func writeLayerTar(t *testing.T, files []layerFile, mtime time.Time, uid int) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		header := &tar.Header{
+			Name:     f.name,
+			Mode:     int64(f.mode),
+			Size:     int64(len(f.content)),
+			ModTime:  mtime,
+			Uid:      uid,
+			Gid:      uid,
+			Uname:    "builder",
+			Typeflag: tar.TypeReg,
+		}
+		if strings.HasSuffix(f.name, "/") {
+			header.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "layer.tar")
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func buildLayer(t *testing.T, layer model.LocalLayer) *LayerBuildController {
+	lb := NewLayerBuildController(layer)
+	if err := lb.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	return lb
+}
+
+// layerHeaders returns the headers of the entries of the built layer
+func layerHeaders(t *testing.T, lb *LayerBuildController) []*tar.Header {
+	gz, err := gzip.NewReader(bytes.NewReader(lb.Blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID, _ := digest.FromBytes(raw); diffID.String() != lb.DiffID {
+		t.Errorf("DiffID = %s, want %s", lb.DiffID, diffID)
+	}
+
+	var headers []*tar.Header
+	tr := tar.NewReader(bytes.NewReader(raw))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+}
+
+func TestLayerBuildReproducible(t *testing.T) {
+	reversed := make([]layerFile, 0, len(layerFiles))
+	for i := len(layerFiles) - 1; i >= 0; i-- {
+		reversed = append(reversed, layerFiles[i])
+	}
+	now := time.Now()
+
+	want := buildLayer(t, model.LocalLayer{Path: writeLayerDir(t, layerFiles, now, 0)})
+	for name, path := range map[string]string{
+		"directory":          writeLayerDir(t, reversed, now.Add(-time.Hour), 1000),
+		"tar":                writeLayerTar(t, layerFiles, now, 0),
+		"tar in other order": writeLayerTar(t, reversed, now.Add(time.Hour), 1000),
+	} {
+		lb := buildLayer(t, model.LocalLayer{Path: path})
+		if lb.BlobSum != want.BlobSum || lb.DiffID != want.DiffID {
+			t.Errorf("%s: layer %s, diff_id %s, want %s, %s", name, lb.BlobSum, lb.DiffID, want.BlobSum, want.DiffID)
+		}
+	}
+
+	var names []string
+	for _, header := range layerHeaders(t, want) {
+		names = append(names, header.Name)
+		if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || !header.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%s is owned by %d:%d %q, mtime %s, want root and epoch",
+				header.Name, header.Uid, header.Gid, header.Uname, header.ModTime)
+		}
+	}
+	if got, want := strings.Join(names, " "), "etc/ etc/app.conf usr/ usr/bin/ usr/bin/app usr/bin/tool"; got != want {
+		t.Errorf("entries = %s, want %s", got, want)
+	}
+}
+
+func TestLayerBuildWhiteouts(t *testing.T) {
+	dir := writeLayerDir(t, layerFiles, time.Now(), 0)
+	lb := buildLayer(t, model.LocalLayer{
+		Path:     dir,
+		Removals: []string{"etc/old.conf", "/var/cache/", "../tmp/x", "usr/bin/app"},
+	})
+
+	headers := make(map[string]*tar.Header)
+	for _, header := range layerHeaders(t, lb) {
+		headers[header.Name] = header
+	}
+	for _, name := range []string{"etc/.wh.old.conf", "var/.wh.cache", "tmp/.wh.x", "usr/bin/.wh.app"} {
+		header, ok := headers[name]
+		if !ok {
+			t.Errorf("whiteout %s not found in %v", name, headers)
+			continue
+		}
+		if header.Typeflag != tar.TypeReg || header.Size != 0 {
+			t.Errorf("whiteout %s is of type %c and %d bytes, want an empty file", name, header.Typeflag, header.Size)
+		}
+	}
+	// the files of the directory are kept beside the whiteouts
+	if _, ok := headers["usr/bin/app"]; !ok {
+		t.Error("usr/bin/app of the directory not found")
+	}
+
+	for _, removal := range []string{"/", ".", "../"} {
+		err := NewLayerBuildController(model.LocalLayer{Path: dir, Removals: []string{removal}}).Load(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "invalid path to remove") {
+			t.Errorf("removal %q: error = %v, want invalid path", removal, err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// LocalSourceController reads an image from an OCI image layout directory or
+// a docker archive, converting its config into a schema1 manifest so the
+// image can be overlaid like one in registry.
+type LocalSourceController struct {
+	source model.LocalSource
+
+	// Manifest is the schema1 manifest converted from the image config
+	Manifest model.Manifest
+
+	// blobs maps the blob sums of the layers to their files in OCI image
+	// layout, or to their entries in docker archive
+	blobs map[string]string
+}
+
+func NewLocalSourceController(src model.LocalSource) *LocalSourceController {
+	return &LocalSourceController{source: src, blobs: make(map[string]string)}
+}
+
+// v1Layer is the v1Compatibility of a layer converted from an image config
+type v1Layer struct {
+	ID              string          `json:"id"`
+	Parent          string          `json:"parent,omitempty"`
+	Created         *time.Time      `json:"created,omitempty"`
+	Author          string          `json:"author,omitempty"`
+	Comment         string          `json:"comment,omitempty"`
+	Architecture    string          `json:"architecture,omitempty"`
+	OS              string          `json:"os,omitempty"`
+	Config          json.RawMessage `json:"config,omitempty"`
+	ContainerConfig json.RawMessage `json:"container_config,omitempty"`
+	ThrowAway       bool            `json:"throwaway,omitempty"`
+}
+
+// Load reads the config and locates the layers of the image, then converts
+// them into Manifest.
+func (lc *LocalSourceController) Load(ctx context.Context) error {
+	log.FromContext(ctx).Debugf("ready to load local image %s", lc.source)
+
+	var config []byte
+	var layers []string
+	var err error
+	switch lc.source.Format {
+	case model.LocalSourceOCI:
+		config, layers, err = lc.loadOCILayout()
+	case model.LocalSourceDockerArchive:
+		config, layers, err = lc.loadDockerArchive()
+	default:
+		err = fmt.Errorf("unknown local image format %s", lc.source.Format)
+	}
+	if err != nil {
+		return err
+	}
+	if err := lc.convert(config, layers); err != nil {
+		return fmt.Errorf("error convert config of %s: %s", lc.source, err)
+	}
+
+	log.FromContext(ctx).Debugf("finish load local image %s", lc.source)
+	return nil
+}
+
+// loadOCILayout returns the config and the blob sums of the layers,
+// from the bottom one, of the image tagged Ref in OCI image layout.
+func (lc *LocalSourceController) loadOCILayout() ([]byte, []string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(lc.source.Path, "index.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var index model.OCIIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, nil, fmt.Errorf("error parse index.json of %s: %s", lc.source.Path, err)
+	}
+
+	var descs []model.Descriptor
+	for _, desc := range index.Manifests {
+		if lc.source.Ref == "" || desc.Annotations[model.OCIRefNameAnnotation] == lc.source.Ref {
+			descs = append(descs, desc)
+		}
+	}
+	if err := lc.checkMatches(len(descs)); err != nil {
+		return nil, nil, err
+	}
+	if descs[0].MediaType != model.MediaTypeOCIManifest && descs[0].MediaType != model.MediaTypeDockerManifest {
+		return nil, nil, fmt.Errorf("unsupported manifest %s of media type %s", descs[0].Digest, descs[0].MediaType)
+	}
+
+	if data, err = lc.readOCIBlob(descs[0].Digest); err != nil {
+		return nil, nil, err
+	}
+	var m model.OCIManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("error parse manifest %s: %s", descs[0].Digest, err)
+	}
+
+	config, err := lc.readOCIBlob(m.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var layers []string
+	for _, layer := range m.Layers {
+		path, err := lc.ociBlobPath(layer.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		lc.blobs[layer.Digest] = path
+		layers = append(layers, layer.Digest)
+	}
+	return config, layers, nil
+}
+
+// readOCIBlob reads the blob dgst of OCI image layout, checking its digest.
+func (lc *LocalSourceController) readOCIBlob(dgst string) ([]byte, error) {
+	path, err := lc.ociBlobPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := digest.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if actual.String() != dgst {
+		return nil, fmt.Errorf("blob %s of %s has digest %s", dgst, lc.source.Path, actual)
+	}
+	return data, nil
+}
+
+func (lc *LocalSourceController) ociBlobPath(dgst string) (string, error) {
+	d, err := digest.ParseDigest(dgst)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(lc.source.Path, "blobs", string(d.Algorithm()), d.Hex()), nil
+}
+
+// loadDockerArchive returns the config and the blob sums of the layers,
+// from the bottom one, of the image tagged Ref in docker archive.
+func (lc *LocalSourceController) loadDockerArchive() ([]byte, []string, error) {
+	data, err := lc.readArchiveEntry(model.ArchiveManifestFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []model.ArchiveManifest
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, nil, fmt.Errorf("error parse %s of %s: %s", model.ArchiveManifestFile, lc.source.Path, err)
+	}
+
+	var matches []model.ArchiveManifest
+	for _, entry := range entries {
+		if lc.source.Ref == "" {
+			matches = append(matches, entry)
+			continue
+		}
+		for _, repoTag := range entry.RepoTags {
+			if repoTag == lc.source.Ref || strings.HasSuffix(repoTag, ":"+lc.source.Ref) {
+				matches = append(matches, entry)
+				break
+			}
+		}
+	}
+	if err := lc.checkMatches(len(matches)); err != nil {
+		return nil, nil, err
+	}
+
+	config, err := lc.readArchiveEntry(matches[0].Config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	digests := make(map[string]string)
+	for _, name := range matches[0].Layers {
+		digests[name] = ""
+	}
+	err = lc.walkArchive(func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if _, ok := digests[hdr.Name]; !ok {
+			return false, nil
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return true, err
+		}
+		digests[hdr.Name] = digest.NewDigest(digest.SHA256, h).String()
+		return false, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var layers []string
+	for _, name := range matches[0].Layers {
+		if digests[name] == "" {
+			return nil, nil, fmt.Errorf("layer %s not found in %s", name, lc.source.Path)
+		}
+		lc.blobs[digests[name]] = name
+		layers = append(layers, digests[name])
+	}
+	return config, layers, nil
+}
+
+// readArchiveEntry reads the file name in docker archive.
+func (lc *LocalSourceController) readArchiveEntry(name string) ([]byte, error) {
+	var data []byte
+	err := lc.walkArchive(func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if hdr.Name != name {
+			return false, nil
+		}
+		var err error
+		data, err = ioutil.ReadAll(r)
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s not found in %s", name, lc.source.Path)
+	}
+	return data, nil
+}
+
+// walkArchive calls fn for the entries of docker archive until it returns
+// true or an error.
+func (lc *LocalSourceController) walkArchive(fn func(*tar.Header, io.Reader) (bool, error)) error {
+	f, err := os.Open(lc.source.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error read %s: %s", lc.source.Path, err)
+		}
+		if done, err := fn(hdr, tr); done || err != nil {
+			return err
+		}
+	}
+}
+
+// checkMatches makes sure Ref selects exactly one image
+func (lc *LocalSourceController) checkMatches(n int) error {
+	switch {
+	case n == 0 && lc.source.Ref == "":
+		return fmt.Errorf("no image found in %s", lc.source.Path)
+	case n == 0:
+		return fmt.Errorf("no image tagged %s found in %s", lc.source.Ref, lc.source.Path)
+	case n > 1 && lc.source.Ref == "":
+		return fmt.Errorf("%d images found in %s, the tag of the image is required", n, lc.source.Path)
+	case n > 1:
+		return fmt.Errorf("%d images tagged %s found in %s", n, lc.source.Ref, lc.source.Path)
+	}
+	return nil
+}
+
+// convert builds Manifest from the image config and the blob sums of the
+// layers. Every layer gets the config of the image, so it is kept whichever
+// layers are overlaid.
+func (lc *LocalSourceController) convert(data []byte, layers []string) error {
+	var config model.ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return fmt.Errorf("%d diff_ids for %d layers", len(config.RootFS.DiffIDs), len(layers))
+	}
+
+	history := config.History
+	if len(history) == 0 {
+		for range layers {
+			history = append(history, model.ImageHistory{Created: config.Created})
+		}
+	}
+
+	m := manifest.Manifest{
+		Versioned:    manifest.Versioned{SchemaVersion: 1},
+		Name:         lc.source.Path,
+		Tag:          lc.source.Ref,
+		Architecture: config.Architecture,
+	}
+	parent := ""
+	for i, h := range history {
+		blobSum := model.EmptyLayerBlobSum
+		if !h.EmptyLayer {
+			if len(layers) == 0 {
+				return fmt.Errorf("more history entries than layers")
+			}
+			blobSum, layers = layers[0], layers[1:]
+		}
+
+		v1 := v1Layer{
+			ID:              utils.GenerateRandomID(),
+			Parent:          parent,
+			Created:         h.Created,
+			Author:          h.Author,
+			Comment:         h.Comment,
+			Config:          config.Config,
+			ContainerConfig: config.Config,
+			ThrowAway:       h.EmptyLayer,
+		}
+		if i == len(history)-1 {
+			v1.Architecture = config.Architecture
+			v1.OS = config.OS
+		}
+		v1Compatibility, err := json.Marshal(v1)
+		if err != nil {
+			return err
+		}
+		parent = v1.ID
+
+		dgst, err := digest.ParseDigest(blobSum)
+		if err != nil {
+			return err
+		}
+		m.FSLayers = append([]manifest.FSLayer{{BlobSum: dgst}}, m.FSLayers...)
+		m.History = append([]manifest.History{{V1Compatibility: string(v1Compatibility)}}, m.History...)
+	}
+	if len(layers) != 0 {
+		return fmt.Errorf("more layers than history entries")
+	}
+
+	lc.Manifest = model.Manifest{Manifest: m}
+	return nil
+}
+
+// Open opens the content of the blob blobSum of the image for reading,
+// the caller must close it.
+func (lc *LocalSourceController) Open(ctx context.Context, blobSum string) (io.ReadCloser, error) {
+	name, ok := lc.blobs[blobSum]
+	if !ok {
+		if blobSum == model.EmptyLayerBlobSum {
+			return ioutil.NopCloser(bytes.NewReader(model.EmptyLayer)), nil
+		}
+		return nil, fmt.Errorf("blob %s not found in %s", blobSum, lc.source)
+	}
+	if lc.source.Format == model.LocalSourceOCI {
+		return os.Open(name)
+	}
+
+	f, err := os.Open(lc.source.Path)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error read %s of %s: %s", name, lc.source.Path, err)
+		}
+		if hdr.Name == name {
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, f}, nil
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package controller
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/libtrust"
 
 	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
 	"github.com/laincloud/registry-fake-pusher/rfp/utils"
 	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
 )
@@ -24,104 +28,190 @@ type ManifestController struct {
 
 	// Token is the certificate to use registry api
 	Token string
-}
 
-func NewManifestController(i model.ImageLocation, jwt string) (*ManifestController, error) {
-	log.Debugf("new manifest controller for %s/%s:%s", i.Registry, i.Repository, i.Tag)
+	store store.ManifestStore
+}
 
-	mc := &ManifestController{ImageLocation: i}
+func NewManifestController(ctx context.Context, i model.ImageLocation, jwt string, registries *Registries) (*ManifestController, error) {
+	locationLogger(ctx, i).Debugf("new manifest controller for %s", i)
 
-	if len(jwt) > 0 {
-		mc.Token = jwt
-	} else {
-		ac := NewAuthController("", "")
-		token, err := ac.GetAuthToken(mc.ImageLocation.Registry, mc.ImageLocation.Repository)
-		if err != nil {
-			return mc, err
-		}
-		mc.Token = token
+	rs, err := NewRegistryStore(ctx, i, model.RegistryAuth{Token: jwt}, registries)
+	if err != nil {
+		return &ManifestController{ImageLocation: i}, err
 	}
+	mc, err := NewStoreManifestController(ctx, rs.Manifests(), i)
+	mc.Token = rs.Token
+	return mc, err
+}
 
-	if err := mc.load(); err != nil {
+// NewStoreManifestController creates a ManifestController loading the
+// manifest of i from s, where the new manifest is pushed too. Only the tag
+// and digest of i are used to locate the manifest in s.
+func NewStoreManifestController(ctx context.Context, s store.ManifestStore, i model.ImageLocation) (*ManifestController, error) {
+	mc := &ManifestController{ImageLocation: i, store: s}
+	if err := mc.load(ctx); err != nil {
 		return mc, err
 	}
-
 	return mc, nil
 }
 
-func (mc *ManifestController) load() error {
-	log.Debugf("ready to load manifest")
+func (mc *ManifestController) load(ctx context.Context) error {
+	logger := locationLogger(ctx, mc.ImageLocation)
+	logger.Debugf("ready to load manifest of %s", mc.ImageLocation.Reference())
 
-	url := mc.ImageLocation.GetManifestUrl()
-	req, err := http.NewRequest("GET", url, nil)
+	raw, _, err := mc.store.Get(ctx, mc.ImageLocation.Reference())
+	if err == store.ErrNotFound {
+		return fmt.Errorf("manifest of %s not found", mc.ImageLocation)
+	}
 	if err != nil {
 		return err
 	}
 
-	mc.addAuthHeader(req)
-	resp, err := http.DefaultClient.Do(req)
+	if mc.ImageLocation.Digest != "" {
+		if err := verifyManifestDigest(raw, mc.ImageLocation.Digest); err != nil {
+			return fmt.Errorf("error verify manifest of %s: %s", mc.ImageLocation, err)
+		}
+	}
+
+	if err := json.Unmarshal(raw, &mc.SignedManifest); err != nil {
+		return fmt.Errorf("error parse manifest of %s: %s", mc.ImageLocation, err)
+	}
+	logger.Debugf("finish load manifest of %s", mc.ImageLocation.Reference())
+	return nil
+}
+
+// Verify checks the signatures of the loaded manifest, returning the keys
+// which signed it. If trustedKeys is not empty, at least one of the keys
+// signing the manifest must be one of them.
+func (mc *ManifestController) Verify(ctx context.Context, trustedKeys []libtrust.PublicKey) ([]libtrust.PublicKey, error) {
+	logger := locationLogger(ctx, mc.ImageLocation)
+	logger.Debugf("ready to verify manifest of %s", mc.ImageLocation.Reference())
+
+	keys, err := manifest.Verify(&mc.SignedManifest.SignedManifest)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid signature of manifest %s: %s", mc.ImageLocation, err)
+	}
+	if len(trustedKeys) == 0 {
+		return keys, nil
 	}
-	if resp.StatusCode > 300 {
-		return fmt.Errorf("error when loading manifest from %s, status_code=%v",
-			url, resp.StatusCode)
+
+	for _, key := range keys {
+		for _, trusted := range trustedKeys {
+			if key.KeyID() == trusted.KeyID() {
+				logger.Debugf("manifest of %s signed by trusted key %s", mc.ImageLocation.Reference(), key.KeyID())
+				return keys, nil
+			}
+		}
 	}
+	return keys, fmt.Errorf("manifest %s is not signed by any trusted key", mc.ImageLocation)
+}
 
-	defer resp.Body.Close()
-	respBytes, err := ioutil.ReadAll(resp.Body)
+// verifyManifestDigest checks the raw manifest against the expected digest,
+// which is either the digest of the content as stored, or for signed schema1
+// manifests the digest of the payload with the signatures stripped.
+func verifyManifestDigest(raw []byte, expected string) error {
+	contentDigest, err := digest.FromBytes(raw)
 	if err != nil {
 		return err
 	}
+	if contentDigest.String() == expected {
+		return nil
+	}
 
-	json.Unmarshal(respBytes, &mc.Manifest)
-	log.Debugf("finish load manifest from %s", url)
+	dgst, err := manifestDigest(raw)
+	if err != nil {
+		return err
+	}
+	if dgst != expected {
+		return fmt.Errorf("manifest digest %s does not match the pinned digest %s", dgst, expected)
+	}
 	return nil
 }
 
-func (mc *ManifestController) Sign() error {
-	trustKey, err := utils.CreateTrustKey()
+// manifestDigest calculates the digest of the raw manifest the way registry
+// does, over the payload with the signatures stripped for signed manifests.
+func manifestDigest(raw []byte) (string, error) {
+	payload := raw
+	if jsig, err := libtrust.ParsePrettySignature(raw, "signatures"); err == nil {
+		if payload, err = jsig.Payload(); err != nil {
+			return "", err
+		}
+	}
+
+	dgst, err := digest.FromBytes(payload)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return dgst.String(), nil
+}
 
+// Sign signs the manifest with trustKey, the signed manifest is the one pushed.
+func (mc *ManifestController) Sign(trustKey libtrust.PrivateKey) error {
 	signed, err := utils.Sign(&mc.Manifest, trustKey)
 	if err != nil {
 		return err
 	}
 
-	mc.SignedManifest = model.SignedManifest{*signed}
+	mc.SignedManifest = model.SignedManifest{SignedManifest: *signed}
 	return nil
 }
 
 // Push pushes the new SignedMainfest in the ManifestController
-// into the location specified by ImageLocation
-func (mc *ManifestController) Push() error {
-	log.Debugf("ready to push new manifest")
+// into the location specified by ImageLocation, returning the
+// digest of the pushed manifest
+func (mc *ManifestController) Push(ctx context.Context) (string, error) {
+	locationLogger(ctx, mc.ImageLocation).Debugf("ready to push new manifest")
+	return mc.put(ctx, mc.ImageLocation.Tag)
+}
 
-	mUploadURL := mc.ImageLocation.GetManifestUrl()
-	req, err := http.NewRequest("PUT", mUploadURL, bytes.NewReader(mc.Raw))
-	if err != nil {
-		return err
+// Retag pushes the manifest once more under tag, returning the digest of
+// the manifest. The tag is part of schema1 manifests, which registry checks
+// against the tag pushed as, so the manifest is signed again with trustKey
+// for tag and its digest differs from the one of the other tags.
+func (mc *ManifestController) Retag(ctx context.Context, tag string, trustKey libtrust.PrivateKey) (string, error) {
+	locationLogger(ctx, mc.ImageLocation).Debugf("ready to retag manifest as %s", tag)
+
+	mc.updateTag(tag)
+	if err := mc.Sign(trustKey); err != nil {
+		return "", err
 	}
-	mc.addAuthHeader(req)
-	resp, err := http.DefaultClient.Do(req)
+	return mc.put(ctx, tag)
+}
+
+func (mc *ManifestController) put(ctx context.Context, tag string) (string, error) {
+	start := time.Now()
+	dgst, err := mc.store.Put(ctx, tag, mc.Raw, manifest.ManifestMediaType)
+	manifestPushDuration.Observe(time.Since(start).Seconds())
+	manifestPushes.Inc(resultLabel(err))
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode > 300 {
-		return fmt.Errorf("error when pushing manifest from %s, status_code=%v",
-			mUploadURL, resp.StatusCode)
+		return "", err
 	}
 
-	log.Debugf("push new manifest success to %s", mUploadURL)
-	return nil
+	locationLogger(ctx, mc.ImageLocation).WithFields(log.Fields{
+		log.FieldDigest:   dgst,
+		log.FieldDuration: log.Duration(time.Since(start)),
+	}).Debugf("push new manifest success as %s", tag)
+	return dgst, nil
+}
+
+// Stat checks whether tag exists in the store of the ManifestController,
+// returning the digest of its manifest when it does. The manifest is not
+// downloaded, so tags of any manifest type are found.
+func (mc *ManifestController) Stat(ctx context.Context, tag string) (bool, string, error) {
+	locationLogger(ctx, mc.ImageLocation).Debugf("ready to stat manifest of tag %s", tag)
+
+	dgst, exists, err := mc.store.Stat(ctx, tag)
+	if err != nil || !exists {
+		return false, "", err
+	}
+	return true, dgst, nil
 }
 
 // Overlay add a new ImageLayer i into the manifest,
 // update the original manifest with Tag tag.
-func (mc *ManifestController) Overlay(i *model.ImageLayer, tag string) {
-	log.Debugf("ready to overlay image layer")
+func (mc *ManifestController) Overlay(ctx context.Context, i *model.ImageLayer, tag string) {
+	logger := locationLogger(ctx, mc.ImageLocation).WithField(log.FieldDigest, i.FSLayer.BlobSum.String())
+	logger.Debugf("ready to overlay image layer")
 
 	m := &mc.Manifest
 	mc.updateTag(tag)
@@ -139,14 +229,11 @@ func (mc *ManifestController) Overlay(i *model.ImageLayer, tag string) {
 	m.FSLayers[0] = i.FSLayer
 	m.History[0] = i.History
 
-	log.Debugf("finish overlay image layer")
+	logger.Debugf("finish overlay image layer")
 }
 
 func (mc *ManifestController) updateTag(tag string) {
 	mc.ImageLocation.Tag = tag
+	mc.ImageLocation.Digest = ""
 	mc.Manifest.Tag = tag
 }
-
-func (mc *ManifestController) addAuthHeader(req *http.Request) {
-	req.Header.Set("Authorization", "Bearer "+mc.Token)
-}
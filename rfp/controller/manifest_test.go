@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/libtrust"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+)
+
+func TestManifestLoad(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	dgst, err := reg.PutImage("app", "1", []string{"A=1"},
+		rfptest.Layer(map[string]string{"base": "base"}), rfptest.Layer(map[string]string{"app": "app"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "app", "1"), "", nil)
+	if err != nil {
+		t.Fatalf("NewManifestController: %s", err)
+	}
+	if len(mc.FSLayers) != 2 || len(mc.History) != 2 {
+		t.Errorf("manifest has %d layers and %d histories, want 2", len(mc.FSLayers), len(mc.History))
+	}
+
+	// pinned by digest
+	loc := model.NewImageLocation(reg.URL(), "app", "")
+	loc.Digest = dgst
+	if _, err := NewManifestController(context.Background(), loc, "", nil); err != nil {
+		t.Errorf("NewManifestController pinned by digest: %s", err)
+	}
+}
+
+func TestManifestLoadErrors(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"app": "app"}))
+	reg.PutImage("app", "2", nil, rfptest.Layer(map[string]string{"app": "app2"}))
+	other, _ := reg.Manifest("app", "2")
+	reg.PutManifest("app", "sha256:0000000000000000000000000000000000000000000000000000000000000000", other, "")
+
+	for _, test := range []struct {
+		name string
+		tag  string
+		dgst string
+		fail bool
+		want string
+	}{
+		{name: "tag not found", tag: "missing", want: "not found"},
+		{name: "digest mismatch", dgst: "sha256:0000000000000000000000000000000000000000000000000000000000000000", want: "does not match"},
+		{name: "server error", tag: "1", fail: true, want: "status_code=500"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.fail {
+				reg.Fail("GET", "/manifests/", http.StatusInternalServerError, 1)
+			}
+			loc := model.NewImageLocation(reg.URL(), "app", test.tag)
+			loc.Digest = test.dgst
+			_, err := NewManifestController(context.Background(), loc, "", nil)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestManifestPushAndStat(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.PutImage("base", "1", nil, rfptest.Layer(map[string]string{"base": "base"}))
+
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "base", "1"), "", nil)
+	if err != nil {
+		t.Fatalf("NewManifestController: %s", err)
+	}
+
+	exists, _, err := mc.Stat(context.Background(), "2")
+	if err != nil || exists {
+		t.Fatalf("Stat of tag 2 = %v, %v, want not exists", exists, err)
+	}
+
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.updateTag("2")
+	if err := mc.Sign(key); err != nil {
+		t.Fatalf("Sign: %s", err)
+	}
+	dgst, err := mc.Push(context.Background())
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if _, ok := reg.Manifest("base", "2"); !ok {
+		t.Fatal("manifest is not pushed as tag 2")
+	}
+	retagged, err := mc.Retag(context.Background(), "3", key)
+	if err != nil {
+		t.Fatalf("Retag: %s", err)
+	}
+	if retagged == dgst {
+		t.Errorf("manifest of tag 3 has the digest %s of tag 2, want signed again for tag 3", dgst)
+	}
+
+	for tag, dgst := range map[string]string{"2": dgst, "3": retagged} {
+		exists, statDigest, err := mc.Stat(context.Background(), tag)
+		if err != nil || !exists || statDigest != dgst {
+			t.Errorf("Stat of tag %s = %v, %s, %v, want %s", tag, exists, statDigest, err, dgst)
+		}
+	}
+}
+
+func TestManifestStatOtherMediaTypes(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.PutImage("base", "1", nil, rfptest.Layer(map[string]string{"base": "base"}))
+	schema2 := reg.PutManifest("base", "v2", []byte(`{"schemaVersion":2}`), model.MediaTypeDockerManifest)
+	oci := reg.PutManifest("base", "oci", []byte(`{"schemaVersion":2,"layers":[]}`), model.MediaTypeOCIManifest)
+
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "base", "1"), "", nil)
+	if err != nil {
+		t.Fatalf("NewManifestController: %s", err)
+	}
+	for tag, dgst := range map[string]string{"v2": schema2, "oci": oci} {
+		exists, statDigest, err := mc.Stat(context.Background(), tag)
+		if err != nil || !exists || statDigest != dgst {
+			t.Errorf("Stat of tag %s = %v, %s, %v, want %s", tag, exists, statDigest, err, dgst)
+		}
+		if n := countRequests(reg, "GET", "/manifests/"+tag); n != 0 {
+			t.Errorf("manifest of tag %s is downloaded %d times by Stat", tag, n)
+		}
+	}
+}
+
+func TestManifestStatWithoutDigest(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	schema1, err := reg.PutImage("base", "1", nil, rfptest.Layer(map[string]string{"base": "base"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema2 := reg.PutManifest("base", "v2", []byte(`{"schemaVersion":2}`), model.MediaTypeDockerManifest)
+	oci := reg.PutManifest("base", "oci", []byte(`{"schemaVersion":2,"layers":[]}`), model.MediaTypeOCIManifest)
+	reg.OmitDigest("HEAD")
+
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "base", "1"), "", nil)
+	if err != nil {
+		t.Fatalf("NewManifestController: %s", err)
+	}
+	for tag, dgst := range map[string]string{"1": schema1, "v2": schema2, "oci": oci} {
+		before := countRequests(reg, "GET", "/manifests/"+tag)
+		exists, statDigest, err := mc.Stat(context.Background(), tag)
+		if err != nil || !exists || statDigest != dgst {
+			t.Errorf("Stat of tag %s = %v, %s, %v, want %s", tag, exists, statDigest, err, dgst)
+		}
+		if n := countRequests(reg, "GET", "/manifests/"+tag) - before; n != 1 {
+			t.Errorf("manifest of tag %s is downloaded %d times by Stat, want once", tag, n)
+		}
+	}
+	if exists, _, err := mc.Stat(context.Background(), "2"); err != nil || exists {
+		t.Errorf("Stat of missing tag = %v, %v, want false", exists, err)
+	}
+}
+
+func TestManifestPushRejected(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.PutImage("base", "1", nil, rfptest.Layer(map[string]string{"base": "base"}))
+	reg.Reject("PUT", "/manifests/2", http.StatusBadRequest, "MANIFEST_INVALID", "manifest invalid",
+		map[string]string{"reason": "unknown blob"})
+
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "base", "1"), "", nil)
+	if err != nil {
+		t.Fatalf("NewManifestController: %s", err)
+	}
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.updateTag("2")
+	if err := mc.Sign(key); err != nil {
+		t.Fatalf("Sign: %s", err)
+	}
+
+	_, err = mc.Push(context.Background())
+	var re *RegistryError
+	if !errors.As(err, &re) {
+		t.Fatalf("error = %v, want a RegistryError", err)
+	}
+	if re.StatusCode != http.StatusBadRequest || re.Code != "MANIFEST_INVALID" || re.Message != "manifest invalid" ||
+		string(re.Detail) != `{"reason":"unknown blob"}` || re.URL != reg.URL()+"/v2/base/manifests/2" {
+		t.Errorf("RegistryError = %+v", re)
+	}
+	want := "status_code=400: MANIFEST_INVALID: manifest invalid, detail: {\"reason\":\"unknown blob\"}"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %q, want containing %q", err, want)
+	}
+
+	// a response without error envelope keeps the status only
+	reg.Fail("PUT", "/manifests/2", http.StatusForbidden, 1)
+	_, err = mc.Push(context.Background())
+	if !errors.As(err, &re) || re.StatusCode != http.StatusForbidden || re.Code != "" || re.Message != "" {
+		t.Errorf("error = %#v, want a RegistryError of status 403 only", err)
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"app": "app"}))
+
+	mc, err := NewManifestController(context.Background(), model.NewImageLocation(reg.URL(), "app", "1"), "", nil)
+	if err != nil {
+		t.Fatalf("NewManifestController: %s", err)
+	}
+
+	keys, err := mc.Verify(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if len(keys) != 1 || keys[0].KeyID() != reg.TrustKey.KeyID() {
+		t.Errorf("manifest is not signed by the key of the registry")
+	}
+
+	if _, err := mc.Verify(context.Background(), []libtrust.PublicKey{reg.TrustKey.PublicKey()}); err != nil {
+		t.Errorf("Verify with the trusted key: %s", err)
+	}
+
+	other, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.Verify(context.Background(), []libtrust.PublicKey{other.PublicKey()}); err == nil {
+		t.Error("Verify succeeded while the manifest is not signed by the trusted key")
+	}
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"github.com/laincloud/registry-fake-pusher/rfp/metrics"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+var (
+	registryRequests = metrics.NewCounterVec("rfp_registry_requests_total",
+		"Requests sent to the registries, by method and status code, error if no response.", "method", "code")
+	tokenFetches = metrics.NewCounterVec("rfp_auth_token_fetches_total",
+		"Tokens requested from the token services of the registries, by result.", "result")
+	blobTransfers = metrics.NewCounterVec("rfp_blob_transfers_total",
+		"Blobs made available in the target stores, by mode: skipped, mounted or copied.", "mode")
+	blobBytes = metrics.NewCounterVec("rfp_blob_bytes_total",
+		"Bytes of blobs downloaded from the source stores or uploaded to the target stores.", "direction")
+	manifestPushes = metrics.NewCounterVec("rfp_manifest_pushes_total",
+		"Manifests pushed, by result.", "result")
+	manifestPushDuration = metrics.NewHistogram("rfp_manifest_push_duration_seconds",
+		"Latency of the manifest pushes.", nil)
+)
+
+// resultLabel is the value of the result label for err
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func countTransfer(mode model.TransferMode, uploaded int) {
+	blobTransfers.Inc(string(mode))
+	if uploaded > 0 {
+		blobBytes.Add(float64(uploaded), "upload")
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"io"
+)
+
+// The directions of the transfers reported to a Progress
+const (
+	ProgressDownload = "download"
+	ProgressUpload   = "upload"
+)
+
+// Progress is notified of the bytes of the blobs transferred
+type Progress interface {
+
+	// Update reports that done bytes of the blob dgst, out of total or -1
+	// if unknown, were transferred in direction. It is called from the
+	// goroutines of the transfers, and once more with done equal to total
+	// when the transfer is complete.
+	Update(dgst, direction string, done, total int64)
+}
+
+// reporter is notified of the bytes of a blob transferred
+type reporter func(done, total int64)
+
+// streamWrapper wraps the streams of the content of a blob, of total
+// bytes or -1 if unknown, transferred by a store
+type streamWrapper func(r io.Reader, total int64) io.Reader
+
+type streamWrapperKey struct{}
+
+// withStreamWrapper returns a copy of ctx whose blob transfers are wrapped by wrap
+func withStreamWrapper(ctx context.Context, wrap streamWrapper) context.Context {
+	return context.WithValue(ctx, streamWrapperKey{}, wrap)
+}
+
+// wrapStream wraps r by the streamWrapper of ctx, if any
+func wrapStream(ctx context.Context, r io.Reader, total int64) io.Reader {
+	if wrap, ok := ctx.Value(streamWrapperKey{}).(streamWrapper); ok {
+		return wrap(r, total)
+	}
+	return r
+}
+
+// progressReader reports the bytes read from r
+type progressReader struct {
+	r      io.Reader
+	done   int64
+	total  int64
+	report reporter
+}
+
+func newProgressReader(r io.Reader, total int64, report reporter) *progressReader {
+	if total < 0 {
+		total = -1
+	}
+	return &progressReader{r: r, total: total, report: report}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.done += int64(n)
+		pr.report(pr.done, pr.total)
+	}
+	return n, err
+}
+
+// wrappedReadCloser is a wrapped body to close
+type wrappedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// withStreams returns a copy of ctx whose transfers of the blob in
+// direction are limited by the RateLimit of bc and reported to its
+// Progress, if any.
+func (bc *BlobController) withStreams(ctx context.Context, direction string) context.Context {
+	if bc.Progress == nil && bc.RateLimit == nil {
+		return ctx
+	}
+	dgst := bc.BlobSum
+	return withStreamWrapper(ctx, func(r io.Reader, total int64) io.Reader {
+		if bc.RateLimit != nil {
+			r = bc.RateLimit.limit(ctx, r)
+		}
+		if bc.Progress != nil {
+			r = newProgressReader(r, total, func(done, total int64) {
+				bc.Progress.Update(dgst, direction, done, total)
+			})
+		}
+		return r
+	})
+}
+
+// reportDone reports the transfer of the size bytes of the blob in
+// direction as complete, whatever the store reported.
+func (bc *BlobController) reportDone(direction string, size int64) {
+	if bc.Progress != nil {
+		bc.Progress.Update(bc.BlobSum, direction, size, size)
+	}
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"context"
+	"io"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+)
+
+// RateLimit limits the bandwidth of the blob transfers, in bytes per
+// second, both of all of them together and of each of them.
+type RateLimit struct {
+	global      *utils.Limiter
+	perTransfer int64
+}
+
+// NewRateLimit creates a RateLimit of global bytes per second for all
+// the transfers sharing it, and of perTransfer bytes per second for each
+// of them, 0 meaning unlimited.
+func NewRateLimit(global, perTransfer int64) *RateLimit {
+	rl := &RateLimit{perTransfer: perTransfer}
+	if global > 0 {
+		rl.global = utils.NewLimiter(global)
+	}
+	return rl
+}
+
+// limit returns a reader of the transfer of r within the limits
+func (rl *RateLimit) limit(ctx context.Context, r io.Reader) io.Reader {
+	var transfer *utils.Limiter
+	if rl.perTransfer > 0 {
+		transfer = utils.NewLimiter(rl.perTransfer)
+	}
+	return utils.LimitReader(ctx, r, rl.global, transfer)
+}
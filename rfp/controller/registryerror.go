@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody bounds the bytes of an error response read for its details
+const maxErrorBody = 64 << 10
+
+// RegistryError is a failed response of a registry, with the first error
+// of the error envelope of the distribution API in its body, if any.
+type RegistryError struct {
+	// Action is what failed, like "pushing manifest to"
+	Action string `json:"action"`
+
+	// URL is the URL of the request
+	URL string `json:"url"`
+
+	// StatusCode is the HTTP status of the response
+	StatusCode int `json:"statusCode"`
+
+	// Code, Message and Detail are the ones of the first error of the
+	// envelope, like MANIFEST_INVALID, they are empty if there is none
+	Code    string          `json:"code,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// newRegistryError reads the RegistryError of the failed resp to the
+// request of url, the body of resp is left to the caller to close.
+func newRegistryError(action, url string, resp *http.Response) *RegistryError {
+	re := &RegistryError{Action: action, URL: url, StatusCode: resp.StatusCode}
+
+	var envelope struct {
+		Errors []struct {
+			Code    string          `json:"code"`
+			Message string          `json:"message"`
+			Detail  json.RawMessage `json:"detail"`
+		} `json:"errors"`
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil || json.Unmarshal(body, &envelope) != nil || len(envelope.Errors) == 0 {
+		return re
+	}
+	first := envelope.Errors[0]
+	re.Code, re.Message = first.Code, first.Message
+	if detail := strings.TrimSpace(string(first.Detail)); detail != "" && detail != "null" {
+		re.Detail = first.Detail
+	}
+	return re
+}
+
+func (re *RegistryError) Error() string {
+	msg := fmt.Sprintf("error when %s %s, status_code=%v", re.Action, re.URL, re.StatusCode)
+	if re.Code != "" {
+		msg += ": " + re.Code
+	}
+	if re.Message != "" {
+		msg += ": " + re.Message
+	}
+	if len(re.Detail) > 0 {
+		msg += ", detail: " + string(re.Detail)
+	}
+	return msg
+}
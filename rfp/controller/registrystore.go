@@ -0,0 +1,442 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/manifest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// cancelUploadTimeout bounds the DELETE request aborting an upload session
+const cancelUploadTimeout = 10 * time.Second
+
+// linkNextRegexp matches the URL of the next page in Link header
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// RegistryStore is the store.Store of a repository in registry, speaking
+// the registry v2 API.
+type RegistryStore struct {
+
+	// ImageLocation is the registry and repository of the store
+	model.ImageLocation
+
+	// RegistryAuth authenticates the requests to the registry
+	model.RegistryAuth
+
+	// Accept is the media types of the manifests got from the store,
+	// only schema1 manifests are accepted if empty
+	Accept []string
+
+	// registries are the options the registry is accessed with
+	registries *Registries
+}
+
+// NewRegistryStore creates the RegistryStore of the repository of i, accessed
+// with the options of its registry in registries. It authenticates with the
+// docker config file if auth is empty.
+func NewRegistryStore(ctx context.Context, i model.ImageLocation, auth model.RegistryAuth, registries *Registries) (*RegistryStore, error) {
+	rs := &RegistryStore{ImageLocation: i, RegistryAuth: auth, registries: registries}
+	if auth.IsZero() {
+		ac := NewAuthController("", "", registries)
+		auth, err := ac.Authenticate(ctx, i.Registry, i.Repository)
+		if err != nil {
+			return rs, err
+		}
+		rs.RegistryAuth = auth
+	}
+	return rs, nil
+}
+
+func (rs *RegistryStore) Blobs() store.BlobStore {
+	return registryBlobs{rs}
+}
+
+func (rs *RegistryStore) Manifests() store.ManifestStore {
+	return registryManifests{rs}
+}
+
+func (rs *RegistryStore) blobURL(dgst string) string {
+	return fmt.Sprintf("%s/v2/%s/blobs/%s", rs.Registry, rs.Repository, dgst)
+}
+
+func (rs *RegistryStore) manifestURL(ref string) string {
+	return fmt.Sprintf("%s/v2/%s/manifests/%s", rs.Registry, rs.Repository, ref)
+}
+
+// absoluteURL resolves the Location returned by registry,
+// which may be relative to the registry.
+func (rs *RegistryStore) absoluteURL(location string) string {
+	if strings.HasPrefix(location, "/") {
+		return rs.Registry + location
+	}
+	return location
+}
+
+// logger returns the Logger of ctx with the registry and repository of rs
+func (rs *RegistryStore) logger(ctx context.Context) *log.Logger {
+	return locationLogger(ctx, rs.ImageLocation)
+}
+
+// locationLogger returns the Logger of ctx with the registry and repository of i
+func locationLogger(ctx context.Context, i model.ImageLocation) *log.Logger {
+	return log.FromContext(ctx).WithFields(log.Fields{
+		log.FieldRegistry:   i.Host(),
+		log.FieldRepository: i.Repository,
+	})
+}
+
+// client returns the http.Client the registry of rs is accessed with
+func (rs *RegistryStore) client() *http.Client {
+	return rs.registries.Client()
+}
+
+func (rs *RegistryStore) addAuthHeader(req *http.Request) {
+	if rs.Basic != nil {
+		req.SetBasicAuth(rs.Basic.Username, rs.Basic.Password)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+rs.Token)
+}
+
+type registryBlobs struct {
+	*RegistryStore
+}
+
+func (rb registryBlobs) Stat(ctx context.Context, dgst string) (int64, bool, error) {
+	statURL := rb.blobURL(dgst)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", statURL, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	rb.addAuthHeader(req)
+
+	resp, err := rb.client().Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return 0, false, nil
+	case resp.StatusCode > 300:
+		return 0, false, newRegistryError("stating blob", statURL, resp)
+	}
+	return resp.ContentLength, true, nil
+}
+
+func (rb registryBlobs) Open(ctx context.Context, dgst string) (io.ReadCloser, error) {
+	getBlobURL := rb.blobURL(dgst)
+	req, err := http.NewRequestWithContext(ctx, "GET", getBlobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	rb.addAuthHeader(req)
+
+	resp, err := rb.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode > 300 {
+		defer resp.Body.Close()
+		return nil, newRegistryError("downloading blob", getBlobURL, resp)
+	}
+	return wrappedReadCloser{wrapStream(ctx, resp.Body, resp.ContentLength), resp.Body}, nil
+}
+
+// Put uploads the content in a new upload session, which is aborted on failure.
+func (rb registryBlobs) Put(ctx context.Context, dgst string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	location, err := rb.initUpload(ctx)
+	if err != nil {
+		return err
+	}
+	if err := rb.upload(ctx, location, dgst, content); err != nil {
+		rb.cancelUpload(ctx, location)
+		return err
+	}
+	return nil
+}
+
+// Mount tries to mount the blob from the repository of from, which must be
+// in the same registry.
+func (rb registryBlobs) Mount(ctx context.Context, dgst string, from store.BlobStore) (bool, error) {
+	src, ok := from.(registryBlobs)
+	if !ok || src.Registry != rb.Registry {
+		return false, nil
+	}
+	logger := rb.logger(ctx).WithField(log.FieldDigest, dgst)
+	logger.Debugf("ready to mount blob from %s", src.Repository)
+
+	mountURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/?mount=%s&from=%s", rb.Registry,
+		rb.Repository, url.QueryEscape(dgst), url.QueryEscape(src.Repository))
+	req, err := http.NewRequestWithContext(ctx, "POST", mountURL, nil)
+	if err != nil {
+		return false, err
+	}
+	rb.addAuthHeader(req)
+	resp, err := rb.client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusCreated {
+		logger.Debugf("finish mount blob from %s", src.Repository)
+		return true, nil
+	}
+
+	// the registry refused or does not support mounting, cancel the
+	// upload session it may have started instead
+	if location := resp.Header.Get("Location"); resp.StatusCode == http.StatusAccepted && location != "" {
+		rb.cancelUpload(ctx, rb.absoluteURL(location))
+	}
+	return false, nil
+}
+
+// initUpload starts an upload session in the repository,
+// returning the location to upload the blob to.
+func (rb registryBlobs) initUpload(ctx context.Context) (string, error) {
+	initURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", rb.Registry, rb.Repository)
+	initReq, err := http.NewRequestWithContext(ctx, "POST", initURL, nil)
+	if err != nil {
+		return "", err
+	}
+	rb.addAuthHeader(initReq)
+	initResp, err := rb.client().Do(initReq)
+	if err != nil {
+		return "", err
+	}
+	defer initResp.Body.Close()
+	if initResp.StatusCode > 300 {
+		return "", newRegistryError("initial upload of blob", initURL, initResp)
+	}
+	return rb.absoluteURL(initResp.Header.Get("Location")), nil
+}
+
+func (rb registryBlobs) upload(ctx context.Context, location, dgst string, content []byte) error {
+	start := time.Now()
+	logger := rb.logger(ctx).WithField(log.FieldDigest, dgst)
+	logger.Debugf("ready to upload blob content")
+
+	uploadURL, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	params := uploadURL.Query()
+	params.Set("digest", dgst)
+	uploadURL.RawQuery = params.Encode()
+
+	uploadBlobURL := uploadURL.String()
+	uploadReq, err := http.NewRequestWithContext(ctx, "PUT", uploadBlobURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	// the streams, like the progress, start over if the request is retried
+	uploadReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(wrapStream(ctx, bytes.NewReader(content), int64(len(content)))), nil
+	}
+	uploadReq.Body, _ = uploadReq.GetBody()
+	rb.addAuthHeader(uploadReq)
+	uploadReq.Header.Set("Content-Type", "application/octet-stream")
+	uploadResp, err := rb.client().Do(uploadReq)
+	if err != nil {
+		return err
+	}
+	defer uploadResp.Body.Close()
+	if uploadResp.StatusCode > 300 {
+		return newRegistryError("upload of blob", uploadBlobURL, uploadResp)
+	}
+
+	logger.WithField(log.FieldDuration, log.Duration(time.Since(start))).Debugf("finish upload blob content of %d bytes", len(content))
+	return nil
+}
+
+// cancelUpload aborts the upload session at location, it still tries
+// when ctx is already done so no half-uploaded blob is left behind.
+func (rb registryBlobs) cancelUpload(ctx context.Context, location string) {
+	logger := rb.logger(ctx)
+	logger.Debugf("cancel upload of blob at %s", location)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cancelUploadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", location, nil)
+	if err != nil {
+		return
+	}
+	rb.addAuthHeader(req)
+	resp, err := rb.client().Do(req)
+	if err != nil {
+		logger.Warnf("error cancel upload of blob at %s: %s", location, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+type registryManifests struct {
+	*RegistryStore
+}
+
+func (rm registryManifests) Get(ctx context.Context, ref string) ([]byte, string, error) {
+	accept := rm.Accept
+	if len(accept) == 0 {
+		accept = []string{manifest.ManifestMediaType}
+	}
+	return rm.get(ctx, ref, accept)
+}
+
+// get loads the manifest of ref accepting the media types of accept.
+func (rm registryManifests) get(ctx context.Context, ref string, accept []string) ([]byte, string, error) {
+	url := rm.manifestURL(ref)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+	rm.addAuthHeader(req)
+
+	resp, err := rm.client().Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", store.ErrNotFound
+	case resp.StatusCode > 300:
+		return nil, "", newRegistryError("loading manifest from", url, resp)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, resp.Header.Get("Content-Type"), nil
+}
+
+// statAccept is the Accept of Stat, any manifest type
+var statAccept = []string{model.MediaTypeOCIManifest, model.MediaTypeDockerManifest, manifest.ManifestMediaType}
+
+// Stat checks the manifest with a HEAD request accepting any manifest
+// type, so that tags of schema2 and OCI manifests are found as well,
+// the digest is the one reported by the registry. Some registries and
+// proxies report none to HEAD, then the manifest is loaded to compute it.
+func (rm registryManifests) Stat(ctx context.Context, ref string) (string, bool, error) {
+	url := rm.manifestURL(ref)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Accept", strings.Join(statAccept, ", "))
+	rm.addAuthHeader(req)
+
+	resp, err := rm.client().Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode > 300:
+		return "", false, newRegistryError("stating manifest from", url, resp)
+	}
+
+	if dgst := resp.Header.Get("Docker-Content-Digest"); dgst != "" {
+		return dgst, true, nil
+	}
+
+	raw, _, err := rm.get(ctx, ref, statAccept)
+	if err == store.ErrNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	dgst, err := manifestDigest(raw)
+	if err != nil {
+		return "", false, err
+	}
+	return dgst, true, nil
+}
+
+// Put pushes the manifest, the digest is the one reported by the registry
+// if any.
+func (rm registryManifests) Put(ctx context.Context, ref string, content []byte, mediaType string) (string, error) {
+	url := rm.manifestURL(ref)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	rm.addAuthHeader(req)
+	resp, err := rm.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 300 {
+		return "", newRegistryError("pushing manifest to", url, resp)
+	}
+
+	if dgst := resp.Header.Get("Docker-Content-Digest"); dgst != "" {
+		return dgst, nil
+	}
+	return manifestDigest(content)
+}
+
+// Tags lists the tags of the repository, following the pages of the list.
+func (rm registryManifests) Tags(ctx context.Context) ([]string, error) {
+	tags := []string{}
+	next := fmt.Sprintf("%s/v2/%s/tags/list", rm.Registry, rm.Repository)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		rm.addAuthHeader(req)
+		resp, err := rm.client().Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		if resp.StatusCode > 300 {
+			err := newRegistryError("listing tags from", next, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parse tags from %s: %s", next, err)
+		}
+		tags = append(tags, list.Tags...)
+
+		next = ""
+		if m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = rm.absoluteURL(m[1])
+		}
+	}
+	return tags, nil
+}
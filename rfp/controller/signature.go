@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// SignatureController stores and verifies the detached signatures of the
+// manifests in a repository, each signature is an artifact tagged after
+// the digest of the signed manifest.
+type SignatureController struct {
+
+	// ImageLocation is the location of the signed image
+	model.ImageLocation
+
+	// Token is the certificate to use registry api
+	Token string
+
+	store *RegistryStore
+}
+
+func NewSignatureController(ctx context.Context, i model.ImageLocation, jwt string, registries *Registries) (*SignatureController, error) {
+	rs, err := NewRegistryStore(ctx, i, model.RegistryAuth{Token: jwt}, registries)
+	if err != nil {
+		return &SignatureController{ImageLocation: i}, err
+	}
+	return NewStoreSignatureController(rs), nil
+}
+
+// NewStoreSignatureController creates the SignatureController of the
+// repository of rs, authenticated like rs.
+func NewStoreSignatureController(rs *RegistryStore) *SignatureController {
+	signatures := *rs
+	signatures.Accept = []string{model.MediaTypeOCIManifest, model.MediaTypeDockerManifest}
+	return &SignatureController{ImageLocation: rs.ImageLocation, Token: rs.Token, store: &signatures}
+}
+
+// Resolve returns the digest of the image, asking the registry
+// for the current digest of the tag if the image is not pinned.
+func (sc *SignatureController) Resolve(ctx context.Context) (string, error) {
+	if sc.ImageLocation.Digest != "" {
+		return sc.ImageLocation.Digest, nil
+	}
+
+	dgst, exists, err := sc.store.Manifests().Stat(ctx, sc.ImageLocation.Tag)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("manifest of %s not found", sc.ImageLocation)
+	}
+	return dgst, nil
+}
+
+// Sign signs the manifest dgst with key, storing the signature in
+// the repository under the tag returned.
+func (sc *SignatureController) Sign(ctx context.Context, dgst string, key crypto.Signer) (string, error) {
+	logger := locationLogger(ctx, sc.ImageLocation).WithField(log.FieldDigest, dgst)
+	logger.Debugf("ready to sign manifest")
+
+	payload, err := json.Marshal(model.NewSignaturePayload(sc.ImageLocation.Name(), dgst))
+	if err != nil {
+		return "", err
+	}
+	sig, err := utils.SignPayload(key, payload)
+	if err != nil {
+		return "", fmt.Errorf("error sign manifest %s: %s", dgst, err)
+	}
+
+	layer, err := sc.pushBlob(ctx, model.MediaTypeSimpleSigning, payload)
+	if err != nil {
+		return "", err
+	}
+	layer.Annotations = map[string]string{
+		model.SignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "",
+		"os":           "",
+		"config":       map[string]string{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{layer.Digest},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	configDesc, err := sc.pushBlob(ctx, model.MediaTypeOCIConfig, config)
+	if err != nil {
+		return "", err
+	}
+
+	m := model.OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     model.MediaTypeOCIManifest,
+		Config:        configDesc,
+		Layers:        []model.Descriptor{layer},
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	tag := model.SignatureTag(dgst)
+	if err := sc.putManifest(ctx, tag, raw); err != nil {
+		return "", err
+	}
+
+	logger.Debugf("finish sign manifest as %s", tag)
+	return tag, nil
+}
+
+// Verify fetches the detached signature of the manifest dgst,
+// checking it is signed by key for this repository and digest.
+func (sc *SignatureController) Verify(ctx context.Context, dgst string, key crypto.PublicKey) error {
+	logger := locationLogger(ctx, sc.ImageLocation).WithField(log.FieldDigest, dgst)
+	logger.Debugf("ready to verify signature of manifest")
+
+	tag := model.SignatureTag(dgst)
+	m, err := sc.getManifest(ctx, tag)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, layer := range m.Layers {
+		encoded, ok := layer.Annotations[model.SignatureAnnotation]
+		if layer.MediaType != model.MediaTypeSimpleSigning || !ok {
+			continue
+		}
+		if lastErr = sc.verifyLayer(ctx, layer, encoded, dgst, key); lastErr == nil {
+			logger.Debugf("finish verify signature of manifest")
+			return nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no signature found in %s", tag)
+	}
+	return fmt.Errorf("error verify signature of %s@%s: %s", sc.ImageLocation.Name(), dgst, lastErr)
+}
+
+func (sc *SignatureController) verifyLayer(ctx context.Context, layer model.Descriptor, encoded, dgst string, key crypto.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("error decode signature: %s", err)
+	}
+
+	bc := NewStoreBlobController(sc.store.Blobs(), nil, layer.Digest)
+	if err := bc.download(ctx); err != nil {
+		return err
+	}
+	payloadDigest, err := digest.FromBytes(bc.Content)
+	if err != nil {
+		return err
+	}
+	if payloadDigest.String() != layer.Digest {
+		return fmt.Errorf("signed payload digest %s does not match %s", payloadDigest, layer.Digest)
+	}
+
+	if err := utils.VerifyPayload(key, bc.Content, sig); err != nil {
+		return err
+	}
+
+	var payload model.SignaturePayload
+	if err := json.Unmarshal(bc.Content, &payload); err != nil {
+		return fmt.Errorf("error parse signed payload: %s", err)
+	}
+	if payload.Critical.Image.DockerManifestDigest != dgst {
+		return fmt.Errorf("signature is for manifest %s", payload.Critical.Image.DockerManifestDigest)
+	}
+	if payload.Critical.Identity.DockerReference != sc.ImageLocation.Name() {
+		return fmt.Errorf("signature is for repository %s", payload.Critical.Identity.DockerReference)
+	}
+	return nil
+}
+
+// pushBlob uploads content into the repository, returning its descriptor.
+func (sc *SignatureController) pushBlob(ctx context.Context, mediaType string, content []byte) (model.Descriptor, error) {
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		return model.Descriptor{}, err
+	}
+
+	bc := NewStoreBlobController(nil, sc.store.Blobs(), dgst.String())
+	bc.Content = content
+	if _, err := bc.Push(ctx); err != nil {
+		return model.Descriptor{}, fmt.Errorf("error push blob %s: %s", dgst, err)
+	}
+	return model.Descriptor{MediaType: mediaType, Digest: dgst.String(), Size: int64(len(content))}, nil
+}
+
+func (sc *SignatureController) putManifest(ctx context.Context, tag string, raw []byte) error {
+	if _, err := sc.store.Manifests().Put(ctx, tag, raw, model.MediaTypeOCIManifest); err != nil {
+		return fmt.Errorf("error push signature manifest as %s: %s", tag, err)
+	}
+	return nil
+}
+
+func (sc *SignatureController) getManifest(ctx context.Context, tag string) (*model.OCIManifest, error) {
+	raw, _, err := sc.store.Manifests().Get(ctx, tag)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("no signature found at %s", tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m model.OCIManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("error parse signature manifest %s: %s", tag, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+// Registries are the RegistryOptions of the registries by host, with the
+// http.Client the registries are accessed with, which counts the requests
+// by status code and sends them with the options of their registry. A nil
+// Registries uses the default options for every registry.
+type Registries struct {
+	configs map[string]registryConfig
+	client  *http.Client
+}
+
+// defaultRegistries is used for a nil Registries
+var defaultRegistries = newRegistries(nil)
+
+// registryConfig is the RegistryOptions of a registry, with the
+// transport built from them
+type registryConfig struct {
+	opts      model.RegistryOptions
+	transport http.RoundTripper
+}
+
+// NewRegistries creates the Registries of the options of the connections
+// to the registries by host, like registry.example.com:5000.
+func NewRegistries(options map[string]model.RegistryOptions) (*Registries, error) {
+	configs := make(map[string]registryConfig, len(options))
+	for host, opts := range options {
+		config, err := newRegistryConfig(host, opts)
+		if err != nil {
+			return nil, err
+		}
+		configs[host] = config
+	}
+	return newRegistries(configs), nil
+}
+
+func newRegistries(configs map[string]registryConfig) *Registries {
+	rs := &Registries{configs: configs}
+	rs.client = &http.Client{Transport: &registryTransport{registries: rs}}
+	return rs
+}
+
+func newRegistryConfig(host string, opts model.RegistryOptions) (registryConfig, error) {
+	if err := opts.Valid(); err != nil {
+		return registryConfig{}, fmt.Errorf("error in options of registry %s: %s", host, err)
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if opts.CAFile != "" || opts.Insecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+		if opts.CAFile != "" {
+			pem, err := ioutil.ReadFile(opts.CAFile)
+			if err != nil {
+				return registryConfig{}, fmt.Errorf("error read CA of registry %s: %s", host, err)
+			}
+			if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+			}
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return registryConfig{}, fmt.Errorf("no certificate found in CA %s of registry %s", opts.CAFile, host)
+			}
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	}
+	return registryConfig{opts: opts, transport: transport}, nil
+}
+
+// Client returns the http.Client the registries are accessed with
+func (rs *Registries) Client() *http.Client {
+	if rs == nil {
+		return defaultRegistries.client
+	}
+	return rs.client
+}
+
+// Options returns the options of the registry, which may be given with
+// its scheme.
+func (rs *Registries) Options(registry string) model.RegistryOptions {
+	return rs.config(registry).opts
+}
+
+func (rs *Registries) config(registry string) registryConfig {
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	if rs != nil {
+		if config, ok := rs.configs[host]; ok {
+			return config
+		}
+	}
+	return registryConfig{transport: http.DefaultTransport}
+}
+
+type registryTransport struct {
+	registries *Registries
+}
+
+// RoundTrip sends req with the transport of its registry, retrying it
+// as many times as the options of the registry allow.
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	config := t.registries.config(req.URL.Host)
+	backoff := config.opts.RetryBackoff
+	if backoff == 0 {
+		backoff = model.DefaultRetryBackoff
+	}
+
+	logger := log.FromContext(req.Context()).WithField(log.FieldRegistry, req.URL.Host)
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := config.transport.RoundTrip(req)
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		registryRequests.Inc(req.Method, code)
+		logger.WithFields(log.Fields{
+			"status_code":     code,
+			log.FieldDuration: log.Duration(time.Since(start)),
+		}).Debugf("%s %s://%s%s", req.Method, req.URL.Scheme, req.URL.Host, req.URL.Path)
+
+		if attempt >= config.opts.Retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		retry := req.Clone(req.Context())
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, err
+			}
+			retry.Body = body
+		}
+		if resp != nil {
+			logger.Infof("%s %s failed with status_code=%v, retry in %s", req.Method, req.URL, resp.StatusCode, backoff)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			logger.Infof("%s %s failed, retry in %s: %s", req.Method, req.URL, backoff, err)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		req = retry
+		backoff *= 2
+	}
+}
+
+// retryable tells whether req may be sent again after it failed with
+// resp or err, the POST and PATCH requests are never repeated.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE":
+	default:
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
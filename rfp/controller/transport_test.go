@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+)
+
+// registriesOf creates the Registries holding the options of reg
+func registriesOf(t *testing.T, reg *rfptest.Registry, opts model.RegistryOptions) *Registries {
+	registries, err := NewRegistries(map[string]model.RegistryOptions{reg.Host(): opts})
+	if err != nil {
+		t.Fatalf("NewRegistries: %s", err)
+	}
+	return registries
+}
+
+func countRequests(reg *rfptest.Registry, method, path string) int {
+	n := 0
+	for _, req := range reg.Requests() {
+		if req.Method == method && strings.Contains(req.Path, path) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegistryRetries(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"a": "a"}))
+	loc := model.NewImageLocation(reg.URL(), "app", "1")
+
+	reg.Fail("GET", "/manifests/", 503, 1)
+	if _, err := NewManifestController(context.Background(), loc, "", nil); err == nil {
+		t.Fatal("manifest loaded without retries")
+	}
+
+	registries := registriesOf(t, reg, model.RegistryOptions{Retries: 2, RetryBackoff: time.Millisecond})
+	reg.Fail("GET", "/manifests/", 503, 1)
+	reg.Fail("GET", "/manifests/", 429, 1)
+	before := countRequests(reg, "GET", "/manifests/")
+	if _, err := NewManifestController(context.Background(), loc, "", registries); err != nil {
+		t.Fatalf("NewManifestController with retries: %s", err)
+	}
+	if n := countRequests(reg, "GET", "/manifests/") - before; n != 3 {
+		t.Errorf("%d GET requests, want 3", n)
+	}
+
+	// the upload sessions are not started twice
+	reg.Fail("POST", "/blobs/uploads/", 503, 1)
+	bc := NewStoreBlobController(nil, registryBlobs{&RegistryStore{ImageLocation: loc, registries: registries}}, "")
+	bc.Content = []byte("content")
+	dgst, _ := digest.FromBytes(bc.Content)
+	bc.BlobSum = dgst.String()
+	if _, err := bc.Push(context.Background()); err == nil {
+		t.Error("upload retried after POST failed")
+	}
+	if n := countRequests(reg, "POST", "/blobs/uploads/"); n != 1 {
+		t.Errorf("%d POST requests, want 1", n)
+	}
+}
+
+func TestRegistryCA(t *testing.T) {
+	reg := rfptest.NewTLSRegistry()
+	defer reg.Close()
+	reg.PutImage("app", "1", nil, rfptest.Layer(map[string]string{"a": "a"}))
+	loc := model.NewImageLocation(reg.URL(), "app", "1")
+
+	if _, err := NewManifestController(context.Background(), loc, "", nil); err == nil {
+		t.Fatal("certificate of unknown authority accepted")
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(ca, reg.Certificate(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewManifestController(context.Background(), loc, "", registriesOf(t, reg, model.RegistryOptions{CAFile: ca})); err != nil {
+		t.Errorf("NewManifestController with CA: %s", err)
+	}
+	if _, err := NewManifestController(context.Background(), loc, "", registriesOf(t, reg, model.RegistryOptions{Insecure: true})); err != nil {
+		t.Errorf("NewManifestController with insecure: %s", err)
+	}
+
+	missing := model.RegistryOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")}
+	if _, err := NewRegistries(map[string]model.RegistryOptions{reg.Host(): missing}); err == nil {
+		t.Error("missing CA accepted")
+	}
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	reg.SetAuth(rfptest.AuthBasic, "ci", "secret")
+	env := NewAuthController(t.TempDir(), "", registriesOf(t, reg, model.RegistryOptions{Credentials: "env:REG"}))
+	t.Setenv("REG_USERNAME", "ci")
+	t.Setenv("REG_PASSWORD", "secret")
+	auth, err := env.Authenticate(context.Background(), reg.URL(), "app")
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if auth.Basic == nil || auth.Basic.Username != "ci" || auth.Basic.Password != "secret" {
+		t.Errorf("auth = %+v, want the credentials of the environment", auth)
+	}
+
+	// the docker config file is not even read
+	none := NewAuthController(filepath.Join(t.TempDir(), "missing"), "",
+		registriesOf(t, reg, model.RegistryOptions{Credentials: model.CredentialsNone}))
+	auth, err = none.Authenticate(context.Background(), reg.URL(), "app")
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if auth.Basic == nil || *auth.Basic != (model.AuthConfig{}) {
+		t.Errorf("auth = %+v, want no credentials", auth)
+	}
+
+	// the options of other Registries do not leak into the ones of env
+	auth, err = env.Authenticate(context.Background(), reg.URL(), "app")
+	if err != nil || auth.Basic == nil || auth.Basic.Username != "ci" {
+		t.Errorf("auth = %+v, %v, want the credentials of the environment", auth, err)
+	}
+
+	vault := model.RegistryOptions{Credentials: "vault"}
+	if _, err := NewRegistries(map[string]model.RegistryOptions{reg.Host(): vault}); err == nil {
+		t.Error("unknown credentials source accepted")
+	}
+}
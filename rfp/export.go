@@ -0,0 +1,82 @@
+package rfp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// export writes the overlaid image of tMc into OCILayoutPath and/or
+// DockerArchivePath instead of pushing it, the layers in srcBlobs are read
+// by openSrc and all the others by openTarget from the target store.
+func (r *RegistryFakePusher) export(ctx context.Context, result *Result, tMc *controller.ManifestController,
+	tLoc model.ImageLocation, srcBlobs map[string]bool, openSrc, openTarget controller.BlobOpener) error {
+
+	open := func(ctx context.Context, blobSum string) (io.ReadCloser, error) {
+		if srcBlobs[blobSum] {
+			return openSrc(ctx, blobSum)
+		}
+		return openTarget(ctx, blobSum)
+	}
+
+	result.NewReferences = nil
+	if r.OCILayoutPath != "" {
+		for _, tag := range r.NewTags {
+			result.NewReferences = append(result.NewReferences, fmt.Sprintf("oci:%s:%s", r.OCILayoutPath, tag))
+		}
+	}
+	if r.DockerArchivePath != "" {
+		for _, tag := range r.NewTags {
+			result.NewReferences = append(result.NewReferences,
+				fmt.Sprintf("docker-archive:%s:%s:%s", r.DockerArchivePath, tLoc.FamiliarName(), tag))
+		}
+	}
+
+	// the blobs are loaded into the OCI image layout directly, they are
+	// only needed while writing the archive otherwise
+	blobDir := filepath.Join(r.OCILayoutPath, "blobs", "sha256")
+	if r.OCILayoutPath == "" {
+		tmpDir, err := ioutil.TempDir("", "rfp-export-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		blobDir = tmpDir
+	}
+
+	start := time.Now()
+	ec := controller.NewExportController(model.Manifest{Manifest: tMc.Manifest}, open, blobDir)
+	if err := ec.Load(ctx); err != nil {
+		return fmt.Errorf("error export image : %s", err)
+	}
+	if r.OCILayoutPath != "" {
+		if err := ec.WriteOCILayout(ctx, r.OCILayoutPath, r.NewTags); err != nil {
+			return fmt.Errorf("error write OCI image layout : %s", err)
+		}
+	}
+	if r.DockerArchivePath != "" {
+		if err := ec.WriteDockerArchive(ctx, r.DockerArchivePath, tLoc.FamiliarName(), r.NewTags); err != nil {
+			return fmt.Errorf("error write docker archive : %s", err)
+		}
+	}
+	result.Digest = ec.ManifestDigest
+	result.PushDuration = time.Since(start)
+
+	for _, layer := range ec.Layers {
+		if srcBlobs[layer.Digest] {
+			result.Layers = append(result.Layers, LayerResult{
+				Digest: layer.Digest,
+				Size:   layer.Size,
+				Mode:   model.TransferExported,
+			})
+		}
+	}
+	return nil
+}
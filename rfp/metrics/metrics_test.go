@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests.", "method", "code")
+	c.Inc("GET", "200")
+	c.Add(2, "GET", "200")
+	c.Inc("PUT", `50"0`)
+
+	if v := c.Value("GET", "200"); v != 3 {
+		t.Errorf("value = %v, want 3", v)
+	}
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="200"} 3
+test_requests_total{method="PUT",code="50\"0"} 1
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestCounterVecWrongLabels(t *testing.T) {
+	c := NewCounterVec("test_wrong_labels_total", "Wrong labels.", "method")
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on a missing label value")
+		}
+	}()
+	c.Inc()
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 2.55
+test_duration_seconds_count 3
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	b := &CounterVec{name: "b_total", help: "B.", values: map[string]float64{}}
+	a := &CounterVec{name: "a_total", help: "A.", values: map[string]float64{}}
+	r.MustRegister(b)
+	r.MustRegister(a)
+	a.Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "# HELP a_total A.") || !strings.Contains(body, "# HELP b_total B.") {
+		t.Errorf("metrics not sorted by name:\n%s", body)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on a metric registered twice")
+		}
+	}()
+	r.MustRegister(a)
+}
@@ -0,0 +1,23 @@
+package model
+
+const (
+	// ArchiveManifestFile is the file listing the images of a docker save archive
+	ArchiveManifestFile = "manifest.json"
+
+	// ArchiveRepositoriesFile is the file mapping repositories and tags to
+	// the top layer ids in a docker save archive, used by legacy docker
+	ArchiveRepositoriesFile = "repositories"
+
+	// ArchiveLayerVersion is the content of the VERSION file of each layer
+	ArchiveLayerVersion = "1.0"
+)
+
+// ArchiveManifest is an image entry of manifest.json in a docker save archive
+type ArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ArchiveRepositories maps the repositories and tags to the top layer ids
+type ArchiveRepositories map[string]map[string]string
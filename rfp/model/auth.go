@@ -9,6 +9,19 @@ type AuthConfig struct {
 	ServerAddress string `json:"serveraddress,omitempty"`
 }
 
+// RegistryAuth authenticates the requests to a registry, with a bearer
+// Token, or with the Basic credentials of the registries having no token
+// service. The requests are anonymous if both are empty.
+type RegistryAuth struct {
+	Token string
+	Basic *AuthConfig
+}
+
+// IsZero tells whether no authentication is set
+func (a RegistryAuth) IsZero() bool {
+	return a.Token == "" && a.Basic == nil
+}
+
 type Token struct {
 	Token string `json:"token"`
 }
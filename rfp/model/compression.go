@@ -0,0 +1,66 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Compression is the compression of a layer blob
+type Compression string
+
+const (
+	// CompressionNone means the layer blob is the plain tar
+	CompressionNone Compression = "none"
+
+	// CompressionGzip means the layer tar is gzip compressed
+	CompressionGzip Compression = "gzip"
+
+	// CompressionZstd means the layer tar is zstd compressed
+	CompressionZstd Compression = "zstd"
+)
+
+// Recompression is the compression the layers are converted to
+// while they are transferred.
+type Recompression struct {
+	Compression Compression
+
+	// Level is the compression level, 1-9 for gzip and 1-22 for zstd,
+	// the default level of the compression is used if 0
+	Level int
+}
+
+// ParseRecompression parses the recompression like "gzip", "gzip:9" or "zstd:19".
+func ParseRecompression(s string) (Recompression, error) {
+	name, level := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, level = s[:i], s[i+1:]
+	}
+
+	rc := Recompression{Compression: Compression(name)}
+	max := 0
+	switch rc.Compression {
+	case CompressionGzip:
+		max = 9
+	case CompressionZstd:
+		max = 22
+	default:
+		return rc, fmt.Errorf("unsupported compression %q, only gzip and zstd are supported", name)
+	}
+
+	if level != "" {
+		l, err := strconv.Atoi(level)
+		if err != nil || l < 1 || l > max {
+			return rc, fmt.Errorf("invalid %s compression level %q, it must be 1-%d", name, level, max)
+		}
+		rc.Level = l
+	}
+	return rc, nil
+}
+
+func (rc Recompression) String() string {
+	if rc.Level == 0 {
+		return string(rc.Compression)
+	}
+	return fmt.Sprintf("%s:%d", rc.Compression, rc.Level)
+}
@@ -2,6 +2,29 @@ package model
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+const (
+	// DefaultRegistry is the registry used for references without a registry domain
+	DefaultRegistry = "registry-1.docker.io"
+
+	// DefaultTag is the tag used for references without a tag or digest
+	DefaultTag = "latest"
+
+	officialRepositoryPrefix = "library/"
+)
+
+var (
+	repositoryComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRegexp                 = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+	// digestHexSizes are the lengths of the hex encoded digests by algorithm,
+	// which digest.ParseDigest does not check
+	digestHexSizes = map[digest.Algorithm]int{digest.SHA256: 64, digest.SHA384: 96, digest.SHA512: 128}
 )
 
 // ImageLocation describe the location msg for image
@@ -15,17 +38,146 @@ type ImageLocation struct {
 
 	// Tag is the tag of the image in Registry
 	Tag string
+
+	// Digest pins the manifest of the image, it is used instead of Tag
+	// to locate the manifest when set
+	Digest string
 }
 
 func NewImageLocation(reg, rep, tag string) ImageLocation {
-	return ImageLocation{reg, rep, tag}
+	return ImageLocation{Registry: reg, Repository: rep, Tag: tag}
+}
+
+// ParseImageLocation parses a full docker reference string like
+// "registry:5000/repo:tag", "repo@sha256:..." or "repo:tag@sha256:...".
+// References without a registry domain point to the Docker Hub, where
+// single component repositories live under "library/".
+func ParseImageLocation(ref string) (ImageLocation, error) {
+	var loc ImageLocation
+
+	name := ref
+	scheme := ""
+	for _, s := range []string{"http://", "https://"} {
+		if strings.HasPrefix(name, s) {
+			scheme, name = s, name[len(s):]
+		}
+	}
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		dgst, err := digest.ParseDigest(name[i+1:])
+		if err == nil && len(dgst.Hex()) != digestHexSizes[dgst.Algorithm()] {
+			err = digest.ErrDigestInvalidFormat
+		}
+		if err != nil {
+			return loc, fmt.Errorf("invalid digest in reference %s: %s", ref, err)
+		}
+		loc.Digest = dgst.String()
+		name = name[:i]
+	}
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		loc.Tag = name[i+1:]
+		name = name[:i]
+		if !tagRegexp.MatchString(loc.Tag) {
+			return loc, fmt.Errorf("invalid tag in reference %s", ref)
+		}
+	}
+	if loc.Tag == "" && loc.Digest == "" {
+		loc.Tag = DefaultTag
+	}
+
+	loc.Registry, loc.Repository = splitRegistry(name)
+	if loc.Registry == "" {
+		if scheme != "" {
+			return loc, fmt.Errorf("missing registry in reference %s", ref)
+		}
+		loc.Registry = DefaultRegistry
+	}
+	if loc.Registry == DefaultRegistry && !strings.Contains(loc.Repository, "/") {
+		loc.Repository = officialRepositoryPrefix + loc.Repository
+	}
+	loc.Registry = scheme + loc.Registry
+
+	if loc.Repository == "" {
+		return loc, fmt.Errorf("missing repository in reference %s", ref)
+	}
+	for _, c := range strings.Split(loc.Repository, "/") {
+		if !repositoryComponentRegexp.MatchString(c) {
+			return loc, fmt.Errorf("invalid repository name in reference %s", ref)
+		}
+	}
+
+	return loc, nil
+}
+
+// splitRegistry splits the registry domain from a repository name,
+// the first component is a registry if it looks like a host name.
+func splitRegistry(name string) (string, string) {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return "", name
+	}
+
+	domain := name[:i]
+	if !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+		return "", name
+	}
+	switch domain {
+	case "docker.io", "index.docker.io":
+		domain = DefaultRegistry
+	}
+	return domain, name[i+1:]
+}
+
+// Reference returns the digest of the image if pinned, or its tag otherwise.
+func (i ImageLocation) Reference() string {
+	if i.Digest != "" {
+		return i.Digest
+	}
+	return i.Tag
+}
+
+// Host returns the registry domain of the image, without scheme.
+func (i ImageLocation) Host() string {
+	reg := i.Registry
+	for _, s := range []string{"http://", "https://"} {
+		reg = strings.TrimPrefix(reg, s)
+	}
+	return reg
+}
+
+// Name returns the repository name of the image qualified by
+// the registry domain, without scheme.
+func (i ImageLocation) Name() string {
+	return fmt.Sprintf("%s/%s", i.Host(), i.Repository)
+}
+
+// String returns the full reference string of the image.
+func (i ImageLocation) String() string {
+	ref := i.Name()
+	if i.Tag != "" {
+		ref = fmt.Sprintf("%s:%s", ref, i.Tag)
+	}
+	if i.Digest != "" {
+		ref = fmt.Sprintf("%s@%s", ref, i.Digest)
+	}
+	return ref
 }
 
 func (i ImageLocation) GetManifestUrl() string {
 	url := fmt.Sprintf("%s/v2/%s/manifests/%s",
 		i.Registry,
 		i.Repository,
-		i.Tag)
+		i.Reference())
 
 	return url
 }
+
+// FamiliarName returns the repository name of the image the way docker
+// shows it, the Docker Hub registry and "library/" prefix are omitted.
+func (i ImageLocation) FamiliarName() string {
+	if i.Host() != DefaultRegistry {
+		return i.Name()
+	}
+	return strings.TrimPrefix(i.Repository, officialRepositoryPrefix)
+}
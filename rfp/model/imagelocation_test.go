@@ -0,0 +1,84 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageLocation(t *testing.T) {
+	for _, test := range []struct {
+		ref  string
+		want ImageLocation
+	}{
+		{"registry.example.com:5000/team/app:1.0",
+			ImageLocation{Registry: "registry.example.com:5000", Repository: "team/app", Tag: "1.0"}},
+		{"localhost:5000/app",
+			ImageLocation{Registry: "localhost:5000", Repository: "app", Tag: DefaultTag}},
+		{"localhost/app:2",
+			ImageLocation{Registry: "localhost", Repository: "app", Tag: "2"}},
+		{"http://localhost:5000/app:2",
+			ImageLocation{Registry: "http://localhost:5000", Repository: "app", Tag: "2"}},
+		{"busybox",
+			ImageLocation{Registry: DefaultRegistry, Repository: "library/busybox", Tag: DefaultTag}},
+		{"docker.io/busybox:1",
+			ImageLocation{Registry: DefaultRegistry, Repository: "library/busybox", Tag: "1"}},
+		{"team/app:1",
+			ImageLocation{Registry: DefaultRegistry, Repository: "team/app", Tag: "1"}},
+		{"registry.example.com/app@" + testDigest,
+			ImageLocation{Registry: "registry.example.com", Repository: "app", Digest: testDigest}},
+		{"registry.example.com/app:1.0@" + testDigest,
+			ImageLocation{Registry: "registry.example.com", Repository: "app", Tag: "1.0", Digest: testDigest}},
+		{"localhost:5000/app:1.0@" + testDigest,
+			ImageLocation{Registry: "localhost:5000", Repository: "app", Tag: "1.0", Digest: testDigest}},
+	} {
+		t.Run(test.ref, func(t *testing.T) {
+			loc, err := ParseImageLocation(test.ref)
+			if err != nil {
+				t.Fatalf("ParseImageLocation: %s", err)
+			}
+			if loc != test.want {
+				t.Errorf("ParseImageLocation = %+v, want %+v", loc, test.want)
+			}
+		})
+	}
+}
+
+func TestParseImageLocationInvalid(t *testing.T) {
+	for _, test := range []struct {
+		ref, want string
+	}{
+		{"registry.example.com/app@sha256:1234", "invalid digest"},
+		{"registry.example.com/app@md5:0123456789abcdef", "invalid digest"},
+		{"registry.example.com/app:1.0@", "invalid digest"},
+		{"registry.example.com/App:1", "invalid repository name"},
+		{"Team/app:1", "invalid repository name"},
+		{"registry.example.com/app:-1", "invalid tag"},
+		{"registry.example.com/", "missing repository"},
+		{"http://app:1", "missing registry"},
+	} {
+		t.Run(test.ref, func(t *testing.T) {
+			_, err := ParseImageLocation(test.ref)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestImageLocationString(t *testing.T) {
+	for _, ref := range []string{
+		"registry.example.com:5000/team/app:1.0",
+		"registry.example.com/app@" + testDigest,
+		"registry.example.com/app:1.0@" + testDigest,
+	} {
+		loc, err := ParseImageLocation(ref)
+		if err != nil {
+			t.Fatalf("ParseImageLocation(%s): %s", ref, err)
+		}
+		if s := loc.String(); s != ref {
+			t.Errorf("String = %s, want %s", s, ref)
+		}
+	}
+}
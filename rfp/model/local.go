@@ -0,0 +1,96 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// LocalSourceOCI is the format of an OCI image layout directory
+	LocalSourceOCI = "oci"
+
+	// LocalSourceDockerArchive is the format of a `docker save` tar file
+	LocalSourceDockerArchive = "docker-archive"
+
+	// EmptyLayerBlobSum is the digest of EmptyLayer
+	EmptyLayerBlobSum = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+)
+
+// portRegexp matches the port number of a registry and what follows it
+var portRegexp = regexp.MustCompile(`^[0-9]+(/|$)`)
+
+// EmptyLayer is the gzip compressed tar without any entry, the blob of
+// the layers which only change the config of an image in schema1 manifests
+var EmptyLayer = []byte{31, 139, 8, 0, 0, 9, 110, 136, 0, 255, 98, 24, 5, 163, 96, 20, 140,
+	88, 0, 8, 0, 0, 255, 255, 46, 175, 181, 239, 0, 4, 0, 0}
+
+// LocalSource is an image stored in local files instead of a registry
+type LocalSource struct {
+
+	// Format is either LocalSourceOCI or LocalSourceDockerArchive
+	Format string
+
+	// Path is the OCI image layout directory or the docker archive file
+	Path string
+
+	// Ref selects the image in Path, the tag in OCI image layout or the
+	// repository tag in docker archive. It may be empty if Path holds
+	// only one image.
+	Ref string
+}
+
+// ParseLocalSource parses references like "oci:DIR[:TAG]" or
+// "docker-archive:FILE[:REPO:TAG]", the second result is false if ref
+// is not a reference of a local image. A port number after the format,
+// like "oci:5000/repo", makes ref the one of a registry named like the
+// format. The TAG of an OCI image layout follows the last colon, so DIR
+// may contain colons, but must end with a slash if its last element does.
+func ParseLocalSource(ref string) (LocalSource, bool) {
+	for _, format := range []string{LocalSourceOCI, LocalSourceDockerArchive} {
+		if !strings.HasPrefix(ref, format+":") {
+			continue
+		}
+		path := ref[len(format)+1:]
+		if portRegexp.MatchString(path) {
+			return LocalSource{}, false
+		}
+
+		src := LocalSource{Format: format, Path: path}
+		i := strings.Index(path, ":")
+		if format == LocalSourceOCI {
+			i = strings.LastIndex(path, ":")
+			if i >= 0 && !tagRegexp.MatchString(path[i+1:]) {
+				i = -1
+			}
+		}
+		if i >= 0 {
+			src.Path, src.Ref = path[:i], path[i+1:]
+		}
+		return src, true
+	}
+	return LocalSource{}, false
+}
+
+// String returns the reference string of the image.
+func (s LocalSource) String() string {
+	if s.Ref == "" {
+		return fmt.Sprintf("%s:%s", s.Format, s.Path)
+	}
+	return fmt.Sprintf("%s:%s:%s", s.Format, s.Path, s.Ref)
+}
+
+// LocalLayer is a new layer built from local files
+type LocalLayer struct {
+
+	// Path is the directory or the tar file holding the files of the layer
+	Path string
+
+	// Removals are the paths removed from the lower layers by the layer
+	Removals []string
+}
+
+// String returns the reference string of the layer.
+func (l LocalLayer) String() string {
+	return fmt.Sprintf("layer:%s", l.Path)
+}
@@ -0,0 +1,48 @@
+package model
+
+import "testing"
+
+func TestParseLocalSource(t *testing.T) {
+	for _, test := range []struct {
+		ref  string
+		want LocalSource
+	}{
+		{"oci:/data/layout", LocalSource{Format: LocalSourceOCI, Path: "/data/layout"}},
+		{"oci:/data/layout:1.0", LocalSource{Format: LocalSourceOCI, Path: "/data/layout", Ref: "1.0"}},
+		{"oci:./5000/layout", LocalSource{Format: LocalSourceOCI, Path: "./5000/layout"}},
+		{"oci:/data/2024-01-01T10:00/layout", LocalSource{Format: LocalSourceOCI, Path: "/data/2024-01-01T10:00/layout"}},
+		{"oci:/data/2024-01-01T10:00/layout:v2", LocalSource{Format: LocalSourceOCI, Path: "/data/2024-01-01T10:00/layout", Ref: "v2"}},
+		{"oci:/data/build:42/", LocalSource{Format: LocalSourceOCI, Path: "/data/build:42/"}},
+		{"docker-archive:app.tar", LocalSource{Format: LocalSourceDockerArchive, Path: "app.tar"}},
+		{"docker-archive:app.tar:app:1", LocalSource{Format: LocalSourceDockerArchive, Path: "app.tar", Ref: "app:1"}},
+	} {
+		t.Run(test.ref, func(t *testing.T) {
+			src, ok := ParseLocalSource(test.ref)
+			if !ok || src != test.want {
+				t.Errorf("ParseLocalSource = %+v, %v, want %+v", src, ok, test.want)
+			}
+			if s := src.String(); s != test.ref {
+				t.Errorf("String = %s, want %s", s, test.ref)
+			}
+		})
+	}
+}
+
+func TestParseLocalSourceRegistry(t *testing.T) {
+	for _, ref := range []string{
+		"oci:5000/repo",
+		"oci:5000/repo:1",
+		"docker-archive:5000/team/app:1",
+		"registry.example.com/app:1",
+		"app",
+	} {
+		if src, ok := ParseLocalSource(ref); ok {
+			t.Errorf("ParseLocalSource(%s) = %+v, want a registry reference", ref, src)
+		}
+	}
+
+	loc, err := ParseImageLocation("oci:5000/repo:1")
+	if err != nil || loc.Registry != "oci:5000" || loc.Repository != "repo" || loc.Tag != "1" {
+		t.Errorf("ParseImageLocation = %+v, %v, want repo:1 in registry oci:5000", loc, err)
+	}
+}
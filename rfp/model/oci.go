@@ -0,0 +1,93 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// MediaTypeOCIManifest is the media type of OCI image manifest
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIConfig is the media type of OCI image config
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeDockerManifest is the media type of docker image manifest schema 2
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Descriptor describes a content addressable blob
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// OCIManifest is an OCI image manifest
+type OCIManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+const (
+	// MediaTypeOCIIndex is the media type of OCI image index
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	// MediaTypeOCILayer is the media type of uncompressed OCI image layer
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar"
+
+	// MediaTypeOCILayerGzip is the media type of gzip compressed OCI image layer
+	MediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// MediaTypeOCILayerZstd is the media type of zstd compressed OCI image layer
+	MediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// OCIRefNameAnnotation is the annotation of the tag in OCI image index
+	OCIRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	// OCILayoutVersion is the version of OCI image layout written
+	OCILayoutVersion = "1.0.0"
+)
+
+// OCIIndex is an OCI image index, like the index.json of OCI image layout
+type OCIIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// OCILayout is the content of the oci-layout file of OCI image layout
+type OCILayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// ImageConfig is the config of an image, shared by OCI and docker schema 2
+type ImageConfig struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       json.RawMessage `json:"config,omitempty"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []ImageHistory  `json:"history,omitempty"`
+}
+
+// RootFS references the layers of an image by their diff_ids
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ImageHistory describes the history of a layer
+type ImageHistory struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CredentialsDocker reads the credentials from the docker config file
+	CredentialsDocker = "docker"
+
+	// CredentialsNone accesses the registry anonymously
+	CredentialsNone = "none"
+
+	// CredentialsEnv reads the credentials from the environment variables
+	// RFP_USERNAME and RFP_PASSWORD, or PREFIX_USERNAME and PREFIX_PASSWORD
+	// when given as env:PREFIX
+	CredentialsEnv = "env"
+)
+
+// DefaultRetryBackoff is the wait before the first retry of a request
+// to a registry, doubled before each of the next ones
+const DefaultRetryBackoff = 500 * time.Millisecond
+
+// RegistryOptions are the options of the connections to a registry
+type RegistryOptions struct {
+	// Scheme is http or https, probed if empty
+	Scheme string
+
+	// CAFile, if set, is a PEM bundle of the certificates authorities
+	// trusted for the registry, besides the ones of the system
+	CAFile string
+
+	// Insecure disables the verification of the certificate of the registry
+	Insecure bool
+
+	// Credentials is where the credentials of the registry come from,
+	// CredentialsDocker if empty
+	Credentials string
+
+	// Retries is the count of the retries of the requests failing without
+	// response or with a 429 or 5xx status code. Only the requests which
+	// can be repeated safely are retried, not the POST and PATCH ones.
+	Retries int
+
+	// RetryBackoff is the wait before the first retry, DefaultRetryBackoff if 0
+	RetryBackoff time.Duration
+}
+
+// Valid checks the scheme and the credentials source
+func (o RegistryOptions) Valid() error {
+	if o.Scheme != "" && o.Scheme != "http" && o.Scheme != "https" {
+		return fmt.Errorf("unknown scheme %q, must be http or https", o.Scheme)
+	}
+	switch {
+	case o.Credentials == "", o.Credentials == CredentialsDocker, o.Credentials == CredentialsNone,
+		o.Credentials == CredentialsEnv, strings.HasPrefix(o.Credentials, CredentialsEnv+":"):
+	default:
+		return fmt.Errorf("unknown credentials source %q, must be docker, none, env or env:PREFIX", o.Credentials)
+	}
+	if o.Retries < 0 || o.RetryBackoff < 0 {
+		return fmt.Errorf("retries and retry backoff must not be negative")
+	}
+	return nil
+}
+
+// CredentialsEnvPrefix returns the prefix of the environment variables
+// holding the credentials if they come from the environment
+func (o RegistryOptions) CredentialsEnvPrefix() (string, bool) {
+	switch {
+	case o.Credentials == CredentialsEnv:
+		return "RFP", true
+	case strings.HasPrefix(o.Credentials, CredentialsEnv+":"):
+		return strings.TrimPrefix(o.Credentials, CredentialsEnv+":"), true
+	}
+	return "", false
+}
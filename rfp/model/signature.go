@@ -0,0 +1,47 @@
+package model
+
+import (
+	"strings"
+)
+
+const (
+	// MediaTypeSimpleSigning is the media type of the layer holding the signed payload
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// SignatureAnnotation is the annotation of the signed payload layer
+	// holding the base64 encoded signature
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// SignaturePayloadType is the type of the signed payload
+	SignaturePayloadType = "cosign container image signature"
+)
+
+// SignaturePayload is the payload signed by a detached signature,
+// it binds the repository to the digest of the signed manifest.
+type SignaturePayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// NewSignaturePayload creates the payload signing the manifest dgst of repository ref.
+func NewSignaturePayload(ref, dgst string) SignaturePayload {
+	var p SignaturePayload
+	p.Critical.Identity.DockerReference = ref
+	p.Critical.Image.DockerManifestDigest = dgst
+	p.Critical.Type = SignaturePayloadType
+	return p
+}
+
+// SignatureTag returns the tag the detached signature of the
+// manifest dgst is stored under, like "sha256-<hex>.sig".
+func SignatureTag(dgst string) string {
+	return strings.Replace(dgst, ":", "-", 1) + ".sig"
+}
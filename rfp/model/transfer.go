@@ -0,0 +1,25 @@
+package model
+
+// TransferMode tells how a blob is made available in the target repository
+type TransferMode string
+
+const (
+	// TransferSkipped means the blob already exists in the target repository
+	TransferSkipped TransferMode = "skipped"
+
+	// TransferMounted means the blob is mounted from the source repository
+	// of the same registry without moving its content
+	TransferMounted TransferMode = "mounted"
+
+	// TransferCopied means the blob is downloaded from the source
+	// and uploaded to the target
+	TransferCopied TransferMode = "copied"
+
+	// TransferRecompressed means the blob is downloaded from the source,
+	// converted to another compression and uploaded to the target
+	TransferRecompressed TransferMode = "recompressed"
+
+	// TransferExported means the blob is written out as a file
+	// instead of being pushed into the target repository
+	TransferExported TransferMode = "exported"
+)
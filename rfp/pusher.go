@@ -1,25 +1,127 @@
 package rfp
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/libtrust"
 
 	"github.com/laincloud/registry-fake-pusher/rfp/controller"
 	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
 )
 
 type RegistryFakePusher struct {
-	SrcRegistry      string
-	SrcRepository    string
-	SrcTag           string
+	SrcRegistry   string
+	SrcRepository string
+	SrcTag        string
+
+	// SrcLocal, if set, is the OCI image layout or docker archive the
+	// source image is read from instead of SrcRegistry
+	SrcLocal *model.LocalSource
+
+	// SrcLayer, if set, is the local files the only layer to overlay
+	// is built from instead of reading the source image
+	SrcLayer *model.LocalLayer
+
 	TargetRegistry   string
 	TargetRepository string
 	TargetTag        string
-	NewTag           string
+	NewTags          []string
+
+	// Registries are the options of the connections to the registries,
+	// like their CA or retries, the default ones are used if nil
+	Registries *controller.Registries
+
+	// SrcDigest and TargetDigest pin the source and target manifests,
+	// they are used instead of the tags to fetch the manifests when set
+	SrcDigest    string
+	TargetDigest string
+
+	// Force allows NewTags to overwrite tags already existing in TargetRegistry
+	Force bool
+
+	// ExpectedDigest, if set, is the digest the first of NewTags must
+	// currently point to, the push is refused otherwise
+	ExpectedDigest string
+
+	// TrustKeyPath is the private key signing the new manifest, docker's
+	// key.json is used if empty. The key is generated if it does not exist,
+	// which is logged at info level.
+	TrustKeyPath string
+
+	// SkipVerify disables the check of the signatures of source and target manifests
+	SkipVerify bool
+
+	// TrustedKeysPath, if set, is a JWK set or PEM bundle of public keys,
+	// source and target manifests must be signed by one of them
+	TrustedKeysPath string
+
+	// SignatureKeyPath, if set, is an ECDSA or ed25519 private key in PEM format
+	// producing a detached signature of the new manifest stored in TargetRepository
+	SignatureKeyPath string
+
+	// OCILayoutPath, if set, is the OCI image layout directory the new image
+	// is written into instead of being pushed into TargetRegistry
+	OCILayoutPath string
+
+	// DockerArchivePath, if set, is the tar file the new image is written
+	// into in the format of `docker save`, instead of being pushed
+	DockerArchivePath string
+
+	// Recompression, if set, is the compression the overlaid layers are
+	// converted to, instead of being transferred byte for byte
+	Recompression *model.Recompression
+
+	// SrcStore and TargetStore, if set, are the stores the source image is
+	// read from and the new image is written into, instead of SrcRegistry
+	// and TargetRegistry. The manifests are located by the tags and digests.
+	SrcStore    store.Store
+	TargetStore store.Store
+
+	// Webhooks are notified of the Result once FakePush is done,
+	// whether it succeeded or not
+	Webhooks []Webhook
+
+	// SrcCredentials and TargetCredentials, if set, are the username and
+	// password authenticating to the source and target registries instead
+	// of the ones of the docker config file. The old base of a rebase is
+	// read with SrcCredentials.
+	SrcCredentials    *model.AuthConfig
+	TargetCredentials *model.AuthConfig
+
+	// Cache, if set, shares the tokens and the transferred blobs with
+	// the other pushes using it
+	Cache *PushCache
+
+	// Progress, if set, is notified of the bytes of the layers downloaded
+	// from source and uploaded to target
+	Progress controller.Progress
+
+	// RateLimit, if set, limits the bandwidth of the layers downloaded
+	// from source and uploaded to target, it may be shared by pushes
+	RateLimit *controller.RateLimit
 }
 
-func NewRegistryFakePusher(sReg, sRep, sTag, tReg, tRep, tTag, nTag string) (*RegistryFakePusher, error) {
+// NewRegistryFakePusher creates a RegistryFakePusher pushing the result under
+// all the nTags, the first of which is the tag recorded in the new manifest.
+// The registries are accessed with their options in registries.
+func NewRegistryFakePusher(ctx context.Context, registries *controller.Registries, sReg, sRep, sTag, tReg, tRep, tTag string, nTags ...string) (*RegistryFakePusher, error) {
+	if len(nTags) == 0 {
+		return nil, fmt.Errorf("at least one new tag is needed")
+	}
+
 	rfp := &RegistryFakePusher{
 		SrcRegistry:      sReg,
 		SrcRepository:    sRep,
@@ -27,24 +129,115 @@ func NewRegistryFakePusher(sReg, sRep, sTag, tReg, tRep, tTag, nTag string) (*Re
 		TargetRegistry:   tReg,
 		TargetRepository: tRep,
 		TargetTag:        tTag,
-		NewTag:           nTag}
+		NewTags:          nTags,
+		Registries:       registries}
 
-	err := rfp.ValidRegistry()
+	err := rfp.ValidRegistry(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return rfp, nil
 }
 
-func (r *RegistryFakePusher) ValidRegistry() error {
+// NewRegistryFakePusherFromReferences creates a RegistryFakePusher from the full
+// reference strings of the source and target images, like
+// "registry.example.com:5000/repo:tag" or "repo@sha256:...". The source
+// may also be a local image like "oci:DIR:TAG" or "docker-archive:FILE".
+func NewRegistryFakePusherFromReferences(ctx context.Context, registries *controller.Registries, src, target string, nTags ...string) (*RegistryFakePusher, error) {
+	tLoc, err := model.ParseImageLocation(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if local, ok := model.ParseLocalSource(src); ok {
+		return newLocalFakePusher(ctx, &RegistryFakePusher{SrcLocal: &local, Registries: registries}, tLoc, nTags)
+	}
 
-	sReg, err := r.addProperScheme(r.SrcRegistry)
+	sLoc, err := model.ParseImageLocation(src)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	rfp, err := NewRegistryFakePusher(ctx, registries, sLoc.Registry, sLoc.Repository, sLoc.Tag,
+		tLoc.Registry, tLoc.Repository, tLoc.Tag, nTags...)
+	if err != nil {
+		return nil, err
+	}
+	rfp.SrcDigest = sLoc.Digest
+	rfp.TargetDigest = tLoc.Digest
+	return rfp, nil
+}
+
+// NewRegistryFakePusherFromLayer creates a RegistryFakePusher overlaying a
+// new layer built from local files on the target image, referenced by
+// its full reference string.
+func NewRegistryFakePusherFromLayer(ctx context.Context, registries *controller.Registries, layer model.LocalLayer, target string, nTags ...string) (*RegistryFakePusher, error) {
+	tLoc, err := model.ParseImageLocation(target)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalFakePusher(ctx, &RegistryFakePusher{SrcLayer: &layer, Registries: registries}, tLoc, nTags)
+}
+
+// ParseNewTags returns the tags of the new references, which are either
+// bare tags or full references in the repository of the target.
+func ParseNewTags(target string, newRefs []string) ([]string, error) {
+	tLoc, err := model.ParseImageLocation(target)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(newRefs))
+	for _, ref := range newRefs {
+		if !strings.ContainsAny(ref, ":/@") {
+			tags = append(tags, ref)
+			continue
+		}
+
+		nLoc, err := model.ParseImageLocation(ref)
+		if err != nil {
+			return nil, err
+		}
+		if nLoc.Digest != "" {
+			return nil, fmt.Errorf("new reference %s must not contain a digest", ref)
+		}
+		if nLoc.Registry != tLoc.Registry || nLoc.Repository != tLoc.Repository {
+			return nil, fmt.Errorf("new reference %s is not in the repository of %s", ref, target)
+		}
+		tags = append(tags, nLoc.Tag)
+	}
+	return tags, nil
+}
+
+// newLocalFakePusher completes rfp, whose source is not in a registry,
+// with the target location and new tags.
+func newLocalFakePusher(ctx context.Context, rfp *RegistryFakePusher, tLoc model.ImageLocation, nTags []string) (*RegistryFakePusher, error) {
+	if len(nTags) == 0 {
+		return nil, fmt.Errorf("at least one new tag is needed")
+	}
+	rfp.TargetRegistry = tLoc.Registry
+	rfp.TargetRepository = tLoc.Repository
+	rfp.TargetTag = tLoc.Tag
+	rfp.TargetDigest = tLoc.Digest
+	rfp.NewTags = nTags
+
+	if err := rfp.ValidRegistry(ctx); err != nil {
+		return nil, err
+	}
+	return rfp, nil
+}
+
+func (r *RegistryFakePusher) ValidRegistry(ctx context.Context) error {
+
+	if r.SrcLocal == nil && r.SrcLayer == nil {
+		sReg, err := addProperScheme(ctx, r.Registries, r.SrcRegistry)
+		if err != nil {
+			return err
+		}
+		r.SrcRegistry = sReg
 	}
-	r.SrcRegistry = sReg
 
-	tReg, err := r.addProperScheme(r.TargetRegistry)
+	tReg, err := addProperScheme(ctx, r.Registries, r.TargetRegistry)
 	if err != nil {
 		return err
 	}
@@ -53,63 +246,202 @@ func (r *RegistryFakePusher) ValidRegistry() error {
 	return nil
 }
 
-func (r *RegistryFakePusher) addProperScheme(reg string) (string, error) {
+func addProperScheme(ctx context.Context, registries *controller.Registries, reg string) (string, error) {
 	if strings.HasPrefix(reg, "http") || strings.HasPrefix(reg, "https") {
-		if err := r.ping(reg); err != nil {
+		if err := ping(ctx, registries, reg); err != nil {
+			return "", err
+		}
+	} else if scheme := registries.Options(reg).Scheme; scheme != "" {
+		schemeReg := fmt.Sprintf("%s://%s", scheme, reg)
+		if err := ping(ctx, registries, schemeReg); err != nil {
 			return "", err
 		}
+		return schemeReg, nil
 	} else {
 		httpsReg := fmt.Sprintf("https://%s", reg)
-		if err := r.ping(httpsReg); err == nil {
+		if err := ping(ctx, registries, httpsReg); err == nil {
 			return httpsReg, nil
 		}
 
 		httpReg := fmt.Sprintf("http://%s", reg)
-		if err := r.ping(httpReg); err == nil {
+		if err := ping(ctx, registries, httpReg); err == nil {
 			return httpReg, nil
 		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", fmt.Errorf("registry %s is not accessable, please check again.", reg)
 	}
 	return reg, nil
 }
 
-func (r *RegistryFakePusher) ping(registry string) error {
-	client := http.DefaultClient
-	req, err := http.NewRequest("GET", registry, nil)
+func ping(ctx context.Context, registries *controller.Registries, registry string) error {
+	client := registries.Client()
+	req, err := http.NewRequestWithContext(ctx, "GET", registry, nil)
 	if err != nil {
 		return err
 	}
 
-	if _, err = client.Do(req); err != nil {
+	resp, err := client.Do(req)
+	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 	return nil
 }
 
 // FakePush gets the source and target manifest from the specify location,
 // reconstructs a new image layer according the two manifests,
 // overlays the new image layer to the target manifest generating a new manifest,
-// and pushes the related blob and manifest to the registry
-func (r *RegistryFakePusher) FakePush(srcJWT, targetJWT string, srcLayerCount int) error {
-
+// and pushes the related blob and manifest to the registry under every
+// tag in NewTags. The returned Result records as much as was done even
+// if FakePush fails.
+func (r *RegistryFakePusher) FakePush(ctx context.Context, srcJWT, targetJWT string, srcLayerCount int) (*Result, error) {
 	sLoc := model.NewImageLocation(r.SrcRegistry, r.SrcRepository, r.SrcTag)
+	sLoc.Digest = r.SrcDigest
 	tLoc := model.NewImageLocation(r.TargetRegistry, r.TargetRepository, r.TargetTag)
+	tLoc.Digest = r.TargetDigest
+
+	result := &Result{Source: sLoc.String(), Target: tLoc.String()}
+	switch {
+	case r.SrcLocal != nil:
+		result.Source = r.SrcLocal.String()
+	case r.SrcLayer != nil:
+		result.Source = r.SrcLayer.String()
+	}
+	for _, tag := range r.NewTags {
+		result.NewReferences = append(result.NewReferences,
+			model.NewImageLocation(r.TargetRegistry, r.TargetRepository, tag).String())
+	}
+
+	logger := log.FromContext(ctx).WithFields(log.Fields{
+		log.FieldRegistry:   tLoc.Host(),
+		log.FieldRepository: tLoc.Repository,
+	})
+	logger.Debugf("ready to push %s on %s as %s", result.Source, result.Target, strings.Join(r.NewTags, ", "))
 
-	sMc, err := controller.NewManifestController(sLoc, srcJWT)
+	start := time.Now()
+	err := r.fakePush(ctx, result, sLoc, tLoc, model.RegistryAuth{Token: srcJWT}, model.RegistryAuth{Token: targetJWT}, srcLayerCount)
+	result.Duration = time.Since(start)
+	logger = logger.WithField(log.FieldDuration, log.Duration(result.Duration))
 	if err != nil {
-		return fmt.Errorf("error create ManifestController for source manifest: %s", err)
+		result.Error = err.Error()
+		errors.As(err, &result.RegistryError)
+		logger.WithError(err).Warnf("push of %s failed", strings.Join(r.NewTags, ", "))
+	} else {
+		logger.WithField(log.FieldDigest, result.Digest).Infof("push of %s succeeded", strings.Join(r.NewTags, ", "))
+	}
+	r.notify(ctx, result)
+	return result, err
+}
+
+func (r *RegistryFakePusher) fakePush(ctx context.Context, result *Result, sLoc, tLoc model.ImageLocation, sAuth, tAuth model.RegistryAuth, srcLayerCount int) error {
+	var err error
+	if sAuth.IsZero() && r.SrcLocal == nil && r.SrcLayer == nil && r.SrcStore == nil {
+		if sAuth, err = r.authenticate(ctx, sLoc, r.SrcCredentials); err != nil {
+			return fmt.Errorf("error get token for source repository: %s", err)
+		}
+	}
+	if tAuth.IsZero() && r.TargetStore == nil {
+		if tAuth, err = r.authenticate(ctx, tLoc, r.TargetCredentials); err != nil {
+			return fmt.Errorf("error get token for target repository: %s", err)
+		}
+	}
+
+	tStore, err := r.targetStore(ctx, tLoc, tAuth)
+	if err != nil {
+		return err
+	}
+
+	// local source images and layers are not signed, only the target
+	// manifest is verified then
+	var sManifest model.Manifest
+	var sStore store.Store
+	var openSrc controller.BlobOpener
+	var toVerify []*controller.ManifestController
+	switch {
+	case r.SrcLocal != nil:
+		lc := controller.NewLocalSourceController(*r.SrcLocal)
+		if err := lc.Load(ctx); err != nil {
+			return fmt.Errorf("error load local source image: %s", err)
+		}
+		sManifest = lc.Manifest
+		openSrc = lc.Open
+	case r.SrcLayer != nil:
+		if srcLayerCount != 1 {
+			return fmt.Errorf("only one layer is built from %s", r.SrcLayer.Path)
+		}
+		lb := controller.NewLayerBuildController(*r.SrcLayer)
+		if err := lb.Load(ctx); err != nil {
+			return err
+		}
+		sManifest = lb.Manifest
+		openSrc = lb.Open
+	default:
+		if sStore, err = r.srcStore(ctx, sLoc, sAuth); err != nil {
+			return err
+		}
+		sMc, err := controller.NewStoreManifestController(ctx, sStore.Manifests(), sLoc)
+		if err != nil {
+			return fmt.Errorf("error create ManifestController for source manifest: %w", err)
+		}
+		sManifest = model.Manifest{Manifest: sMc.Manifest}
+		toVerify = append(toVerify, sMc)
 	}
-	tMc, err := controller.NewManifestController(tLoc, targetJWT)
+	tMc, err := controller.NewStoreManifestController(ctx, tStore.Manifests(), tLoc)
 	if err != nil {
-		return fmt.Errorf("error create ManifestController for target manifest: %s", err)
+		return fmt.Errorf("error create ManifestController for target manifest: %w", err)
+	}
+	if !r.SkipVerify {
+		if err := r.verify(ctx, append(toVerify, tMc)...); err != nil {
+			return err
+		}
+	}
+
+	exporting := r.OCILayoutPath != "" || r.DockerArchivePath != ""
+	if exporting && r.SignatureKeyPath != "" {
+		return fmt.Errorf("detached signatures are stored in registry, they are not supported when exporting")
+	}
+	if r.TargetStore != nil && r.SignatureKeyPath != "" {
+		return fmt.Errorf("detached signatures are stored in registry, they are not supported with a target store")
+	}
+
+	var trustKey libtrust.PrivateKey
+	var signatureKey crypto.Signer
+	if !exporting {
+		if err := r.checkNewTags(ctx, tMc); err != nil {
+			return err
+		}
+
+		keyPath := r.TrustKeyPath
+		if keyPath == "" {
+			keyPath = utils.DefaultTrustKeyPath()
+		}
+		var created bool
+		if trustKey, created, err = utils.LoadOrCreateTrustKey(keyPath); err != nil {
+			return err
+		}
+		if created {
+			log.FromContext(ctx).Infof("generated new trust key %s at %s", trustKey.KeyID(), keyPath)
+		}
+		result.KeyID = trustKey.KeyID()
+
+		if r.SignatureKeyPath != "" {
+			if signatureKey, err = utils.LoadSigningKey(r.SignatureKeyPath); err != nil {
+				return err
+			}
+		}
 	}
 
 	var sIl, tIl model.ImageLayer
-	for i := 0; i < srcLayerCount; i++ {
-		if sIl, err = model.NewImageLayer(&model.Manifest{sMc.Manifest}, i); err != nil {
+	srcBlobs := make(map[string]bool)
+	recompressed := make(map[string][]byte)
+	// the layers are overlaid from the bottom one, so they keep their order
+	for i := srcLayerCount - 1; i >= 0; i-- {
+		if sIl, err = model.NewImageLayer(&sManifest, i); err != nil {
 			return err
 		}
-		if tIl, err = model.NewImageLayer(&model.Manifest{tMc.Manifest}, 0); err != nil {
+		if tIl, err = model.NewImageLayer(&model.Manifest{Manifest: tMc.Manifest}, 0); err != nil {
 			return err
 		}
 		ic := controller.NewImageLayerController()
@@ -117,24 +449,228 @@ func (r *RegistryFakePusher) FakePush(srcJWT, targetJWT string, srcLayerCount in
 		if err != nil {
 			return fmt.Errorf("error get to overlay ImageLayer: %s", err)
 		}
-		tMc.Overlay(&newImageLayer, r.NewTag)
 
-		if r.SrcRegistry != r.TargetRegistry || r.SrcRepository != r.TargetRepository {
-			bc, err := controller.NewBlobController(sLoc, tLoc, sIl.FSLayer.BlobSum.String(), srcJWT, targetJWT)
-			if err != nil {
-				return fmt.Errorf("error get the blob controller : %s", err)
+		blobSum := sIl.FSLayer.BlobSum.String()
+		layerStart := time.Now()
+		var bc *controller.BlobController
+		if openSrc != nil {
+			// blobs of local source images are only pushed into target store
+			bc = controller.NewStoreBlobController(nil, tStore.Blobs(), blobSum)
+		} else {
+			bc = controller.NewStoreBlobController(sStore.Blobs(), tStore.Blobs(), blobSum)
+		}
+		bc.Progress = r.Progress
+		bc.RateLimit = r.RateLimit
+
+		// the new layer refers to the recompressed blob, with the same diff_id
+		if r.Recompression != nil {
+			if openSrc != nil {
+				if err := loadLocalBlob(ctx, bc, openSrc); err != nil {
+					return err
+				}
+			}
+			if err := bc.Recompress(ctx, *r.Recompression); err != nil {
+				return err
 			}
+			newImageLayer.FSLayer.BlobSum = digest.Digest(bc.BlobSum)
+			if exporting {
+				recompressed[bc.BlobSum] = bc.Content
+			}
+		}
+		tMc.Overlay(ctx, &newImageLayer, r.NewTags[0])
+
+		srcBlobs[bc.BlobSum] = true
+		if exporting {
+			continue
+		}
 
-			if err := bc.Transfer(); err != nil {
-				return fmt.Errorf("error transter blob: %s", err)
+		var mode model.TransferMode
+		switch {
+		case r.Recompression != nil:
+			mode, err = bc.Push(ctx)
+			if mode == model.TransferCopied && bc.BlobSum != blobSum {
+				mode = model.TransferRecompressed
 			}
+		case openSrc != nil:
+			mode, err = pushLocalBlob(ctx, bc, openSrc)
+		case r.Cache != nil:
+			mode, err = r.Cache.transfer(ctx, tLoc, bc)
+		default:
+			mode, err = bc.Transfer(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("error transter blob: %w", err)
+		}
+		layer := LayerResult{
+			Digest:   bc.BlobSum,
+			Size:     bc.Size,
+			Mode:     mode,
+			Duration: time.Since(layerStart),
+		}
+		if bc.BlobSum != blobSum {
+			layer.SourceDigest = blobSum
+		}
+		result.Layers = append(result.Layers, layer)
+	}
+	if exporting {
+		if openSrc == nil {
+			openSrc = sStore.Blobs().Open
+		}
+		if len(recompressed) > 0 {
+			openSrc = openRecompressed(recompressed, openSrc)
+		}
+		return r.export(ctx, result, tMc, tLoc, srcBlobs, openSrc, tStore.Blobs().Open)
+	}
+
+	if err := tMc.Sign(trustKey); err != nil {
+		return fmt.Errorf("error sign new manifest : %s", err)
+	}
+
+	pushStart := time.Now()
+	dgst, err := tMc.Push(ctx)
+	if err != nil {
+		return fmt.Errorf("error push new manifest : %w", err)
+	}
+	result.Digest = dgst
+	result.Digests = []string{dgst}
+	for _, tag := range r.NewTags[1:] {
+		tagDigest, err := tMc.Retag(ctx, tag, trustKey)
+		if err != nil {
+			return fmt.Errorf("error push new manifest as tag %s : %w", tag, err)
+		}
+		result.Digests = append(result.Digests, tagDigest)
+	}
+	result.PushDuration = time.Since(pushStart)
+
+	if signatureKey != nil {
+		// the target is a registry, signatures are refused with a TargetStore
+		sc := controller.NewStoreSignatureController(tStore.(*controller.RegistryStore))
+		tag, err := sc.Sign(ctx, dgst, signatureKey)
+		if err != nil {
+			return err
 		}
+		result.Signature = model.NewImageLocation(r.TargetRegistry, r.TargetRepository, tag).String()
+	}
+
+	return nil
+}
+
+// authenticate returns the RegistryAuth of the repository of loc, with the
+// credentials if any, else shared by Cache if any. It is empty if the store
+// is left to authenticate with the docker config file.
+func (r *RegistryFakePusher) authenticate(ctx context.Context, loc model.ImageLocation, credentials *model.AuthConfig) (model.RegistryAuth, error) {
+	switch {
+	case credentials != nil:
+		return controller.NewCredentialsAuthController(credentials.Username, credentials.Password, r.Registries).
+			Authenticate(ctx, loc.Registry, loc.Repository)
+	case r.Cache != nil:
+		return r.Cache.auth(ctx, loc, r.Registries)
+	}
+	return model.RegistryAuth{}, nil
+}
+
+// srcStore returns SrcStore, or the store of the source repository in registry.
+func (r *RegistryFakePusher) srcStore(ctx context.Context, sLoc model.ImageLocation, sAuth model.RegistryAuth) (store.Store, error) {
+	if r.SrcStore != nil {
+		return r.SrcStore, nil
+	}
+	rs, err := controller.NewRegistryStore(ctx, sLoc, sAuth, r.Registries)
+	if err != nil {
+		return nil, fmt.Errorf("error create store of source repository: %s", err)
+	}
+	return rs, nil
+}
+
+// targetStore returns TargetStore, or the store of the target repository in registry.
+func (r *RegistryFakePusher) targetStore(ctx context.Context, tLoc model.ImageLocation, tAuth model.RegistryAuth) (store.Store, error) {
+	if r.TargetStore != nil {
+		return r.TargetStore, nil
+	}
+	rs, err := controller.NewRegistryStore(ctx, tLoc, tAuth, r.Registries)
+	if err != nil {
+		return nil, fmt.Errorf("error create store of target repository: %s", err)
+	}
+	return rs, nil
+}
+
+// pushLocalBlob uploads the blob of bc read by open into target store.
+func pushLocalBlob(ctx context.Context, bc *controller.BlobController, open controller.BlobOpener) (model.TransferMode, error) {
+	if err := loadLocalBlob(ctx, bc, open); err != nil {
+		return "", err
 	}
-	tMc.Sign()
+	return bc.Push(ctx)
+}
 
-	if err := tMc.Push(); err != nil {
-		return fmt.Errorf("error push new manifest : %s", err)
+// loadLocalBlob reads the blob of bc by open into its Content.
+func loadLocalBlob(ctx context.Context, bc *controller.BlobController, open controller.BlobOpener) error {
+	body, err := open(ctx, bc.BlobSum)
+	if err != nil {
+		return err
 	}
+	defer body.Close()
+	bc.Content, err = ioutil.ReadAll(body)
+	return err
+}
 
+// openRecompressed opens the recompressed blobs from memory,
+// and the others by open.
+func openRecompressed(recompressed map[string][]byte, open controller.BlobOpener) controller.BlobOpener {
+	return func(ctx context.Context, blobSum string) (io.ReadCloser, error) {
+		if content, ok := recompressed[blobSum]; ok {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		return open(ctx, blobSum)
+	}
+}
+
+// verify checks the signatures of the manifests, refusing to build on
+// an image whose signature is invalid or not from a trusted key.
+func (r *RegistryFakePusher) verify(ctx context.Context, mcs ...*controller.ManifestController) error {
+	var trustedKeys []libtrust.PublicKey
+	if r.TrustedKeysPath != "" {
+		keys, err := libtrust.LoadKeySetFile(r.TrustedKeysPath)
+		if err != nil {
+			return fmt.Errorf("error load trusted keys from %s: %s", r.TrustedKeysPath, err)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("no trusted keys found in %s", r.TrustedKeysPath)
+		}
+		trustedKeys = keys
+	}
+
+	for _, mc := range mcs {
+		if _, err := mc.Verify(ctx, trustedKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNewTags makes sure the push of NewTags will not silently overwrite
+// existing tags in the target repository.
+func (r *RegistryFakePusher) checkNewTags(ctx context.Context, tMc *controller.ManifestController) error {
+	for i, tag := range r.NewTags {
+		exists, dgst, err := tMc.Stat(ctx, tag)
+		if err != nil {
+			return fmt.Errorf("error check new tag %s: %w", tag, err)
+		}
+
+		if i == 0 && r.ExpectedDigest != "" {
+			if !exists {
+				return fmt.Errorf("tag %s does not exist in %s, expected digest %s",
+					tag, r.TargetRepository, r.ExpectedDigest)
+			}
+			if dgst != r.ExpectedDigest {
+				return fmt.Errorf("tag %s in %s has digest %s, expected digest %s",
+					tag, r.TargetRepository, dgst, r.ExpectedDigest)
+			}
+			continue
+		}
+
+		if exists && !r.Force {
+			return fmt.Errorf("tag %s already exists in %s with digest %s, refusing to overwrite it without force",
+				tag, r.TargetRepository, dgst)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,442 @@
+package rfp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+	"github.com/laincloud/registry-fake-pusher/rfp/store"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+var (
+	baseLayer = rfptest.Layer(map[string]string{"etc/os-release": "base"})
+	libLayer  = rfptest.Layer(map[string]string{"usr/lib/libapp.so": "lib"})
+	appLayer  = rfptest.Layer(map[string]string{"usr/bin/app": "app"})
+)
+
+// putTestImages puts app:1, built on its own base, into src and
+// base:1 into target.
+func putTestImages(t *testing.T, src, target *rfptest.Registry) {
+	if _, err := src.PutImage("app", "1", []string{"BUILD=1"}, baseLayer, libLayer, appLayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.PutImage("base", "1", []string{"PATH=/bin"}, baseLayer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestPusher(t *testing.T, src, target *rfptest.Registry, nTags ...string) *RegistryFakePusher {
+	pusher, err := NewRegistryFakePusherFromReferences(context.Background(), nil,
+		src.Host()+"/app:1", target.Host()+"/base:1", nTags...)
+	if err != nil {
+		t.Fatalf("NewRegistryFakePusherFromReferences: %s", err)
+	}
+	pusher.TrustKeyPath = filepath.Join(t.TempDir(), "key.json")
+	return pusher
+}
+
+// loadManifest loads the manifest of tag in repository of reg
+func loadManifest(t *testing.T, reg *rfptest.Registry, repository, tag string) manifest.SignedManifest {
+	raw, ok := reg.Manifest(repository, tag)
+	if !ok {
+		t.Fatalf("manifest of %s:%s not found", repository, tag)
+	}
+	var m manifest.SignedManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func blobSum(content []byte) digest.Digest {
+	dgst, _ := digest.FromBytes(content)
+	return dgst
+}
+
+func TestFakePush(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	pusher := newTestPusher(t, reg, reg, "2", "latest")
+	result, err := pusher.FakePush(context.Background(), "", "", 2)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+
+	m := loadManifest(t, reg, "base", "2")
+	wantLayers := []digest.Digest{blobSum(appLayer), blobSum(libLayer), blobSum(baseLayer)}
+	if len(m.FSLayers) != len(wantLayers) {
+		t.Fatalf("new manifest has %d layers, want %d", len(m.FSLayers), len(wantLayers))
+	}
+	for i, want := range wantLayers {
+		if m.FSLayers[i].BlobSum != want {
+			t.Errorf("layer %d = %s, want %s", i, m.FSLayers[i].BlobSum, want)
+		}
+	}
+	if m.Tag != "2" {
+		t.Errorf("tag of new manifest = %q, want 2", m.Tag)
+	}
+	if !strings.Contains(m.History[0].V1Compatibility, "PATH=/bin") {
+		t.Errorf("environment of target is not kept: %s", m.History[0].V1Compatibility)
+	}
+
+	latest := loadManifest(t, reg, "base", "latest")
+	if latest.Tag != "latest" || !reflect.DeepEqual(latest.FSLayers, m.FSLayers) {
+		t.Errorf("latest is not the new manifest signed for tag latest: tag %q, layers %v", latest.Tag, latest.FSLayers)
+	}
+	if len(result.Digests) != 2 || result.Digests[0] != result.Digest || result.Digests[1] == result.Digest {
+		t.Errorf("digests = %v, want the digest %s of tag 2 and another one of latest", result.Digests, result.Digest)
+	}
+
+	if len(result.Layers) != 2 {
+		t.Fatalf("result has %d layers, want 2", len(result.Layers))
+	}
+	for _, layer := range result.Layers {
+		if layer.Mode != model.TransferMounted {
+			t.Errorf("layer %s is %s, want %s", layer.Digest, layer.Mode, model.TransferMounted)
+		}
+	}
+	if result.Digest == "" || result.KeyID == "" {
+		t.Errorf("result misses digest or key id: %+v", result)
+	}
+}
+
+func TestFakePushKeepsLayerOrder(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	if _, err := reg.PutImage("app", "1", nil, baseLayer, libLayer, appLayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.PutImage("base", "1", nil, baseLayer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTestPusher(t, reg, reg, "2").FakePush(context.Background(), "", "", 2); err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+
+	// schema1 lists the layers and their history from the top one, each
+	// layer being the child of the next one
+	m := loadManifest(t, reg, "base", "2")
+	wantLayers := []digest.Digest{blobSum(appLayer), blobSum(libLayer), blobSum(baseLayer)}
+	if len(m.FSLayers) != len(wantLayers) || len(m.History) != len(wantLayers) {
+		t.Fatalf("new manifest has %d layers and %d history entries, want %d", len(m.FSLayers), len(m.History), len(wantLayers))
+	}
+	for i, want := range wantLayers {
+		if m.FSLayers[i].BlobSum != want {
+			t.Errorf("layer %d = %s, want %s", i, m.FSLayers[i].BlobSum, want)
+		}
+	}
+	for i := 0; i+1 < len(m.History); i++ {
+		var image, parent struct {
+			ID     string `json:"id"`
+			Parent string `json:"parent"`
+		}
+		json.Unmarshal([]byte(m.History[i].V1Compatibility), &image)
+		json.Unmarshal([]byte(m.History[i+1].V1Compatibility), &parent)
+		if image.Parent != parent.ID {
+			t.Errorf("parent of layer %d = %s, want the id %s of layer %d", i, image.Parent, parent.ID, i+1)
+		}
+	}
+}
+
+func TestFakePushAcrossRegistriesWithAuth(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	putTestImages(t, src, target)
+	src.SetAuth(rfptest.AuthBearer, "alice", "secret")
+	target.SetAuth(rfptest.AuthBasic, "bob", "pass")
+
+	dir := t.TempDir()
+	config := fmt.Sprintf(`{"auths": {%q: {"auth": %q}, %q: {"auth": %q}}}`,
+		src.Host(), base64.StdEncoding.EncodeToString([]byte("alice:secret")),
+		target.Host(), base64.StdEncoding.EncodeToString([]byte("bob:pass")))
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+
+	pusher := newTestPusher(t, src, target, "2")
+	result, err := pusher.FakePush(context.Background(), "", "", 1)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+	if len(result.Layers) != 1 || result.Layers[0].Mode != model.TransferCopied {
+		t.Errorf("layers = %+v, want one copied", result.Layers)
+	}
+	if _, ok := target.Blob("base", blobSum(appLayer).String()); !ok {
+		t.Error("top layer of app is not copied into target")
+	}
+	if m := loadManifest(t, target, "base", "2"); m.FSLayers[0].BlobSum != blobSum(appLayer) {
+		t.Errorf("top layer of new manifest = %s, want %s", m.FSLayers[0].BlobSum, blobSum(appLayer))
+	}
+}
+
+func TestFakePushLogs(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	var buf bytes.Buffer
+	logger, err := log.New(&buf, "info", log.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := log.NewContext(context.Background(), logger.WithField(log.FieldRequestID, "job-1"))
+	pusher := newTestPusher(t, reg, reg, "2")
+	// the generation of a new key is logged too
+	if _, _, err := utils.LoadOrCreateTrustKey(pusher.TrustKeyPath); err != nil {
+		t.Fatal(err)
+	}
+	result, err := pusher.FakePush(ctx, "", "", 1)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+		t.Fatalf("not a single JSON message: %s\n%s", err, buf.String())
+	}
+	for field, want := range map[string]string{
+		log.FieldRequestID:  "job-1",
+		log.FieldRegistry:   reg.Host(),
+		log.FieldRepository: "base",
+		log.FieldDigest:     result.Digest,
+	} {
+		if msg[field] != want {
+			t.Errorf("%s = %v, want %s", field, msg[field], want)
+		}
+	}
+	if _, ok := msg[log.FieldDuration]; !ok {
+		t.Error("no duration logged")
+	}
+}
+
+func TestFakePushTrustKeyLog(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	var buf bytes.Buffer
+	logger, err := log.New(&buf, "info", log.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := log.NewContext(context.Background(), logger)
+	keyPath := filepath.Join(t.TempDir(), "keys", "key.json")
+	for i, nTag := range []string{"2", "3"} {
+		buf.Reset()
+		pusher := newTestPusher(t, reg, reg, nTag)
+		pusher.TrustKeyPath = keyPath
+		result, err := pusher.FakePush(ctx, "", "", 1)
+		if err != nil {
+			t.Fatalf("FakePush: %s", err)
+		}
+		logged := strings.Contains(buf.String(), "generated new trust key "+result.KeyID+" at "+keyPath)
+		if created := i == 0; logged != created {
+			t.Errorf("push %d: generation logged %t, want %t\n%s", i+1, logged, created, buf.String())
+		}
+	}
+}
+
+func TestFakePushExistingTag(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	first, err := newTestPusher(t, reg, reg, "2").FakePush(context.Background(), "", "", 1)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+
+	pusher := newTestPusher(t, reg, reg, "2")
+	if _, err := pusher.FakePush(context.Background(), "", "", 1); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("error = %v, want refusing to overwrite", err)
+	}
+
+	pusher.ExpectedDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if _, err := pusher.FakePush(context.Background(), "", "", 1); err == nil || !strings.Contains(err.Error(), "expected digest") {
+		t.Errorf("error = %v, want digest mismatch", err)
+	}
+
+	pusher.ExpectedDigest = first.Digest
+	if _, err := pusher.FakePush(context.Background(), "", "", 1); err != nil {
+		t.Errorf("FakePush with the expected digest: %s", err)
+	}
+
+	pusher.ExpectedDigest = ""
+	pusher.Force = true
+	if _, err := pusher.FakePush(context.Background(), "", "", 1); err != nil {
+		t.Errorf("FakePush with force: %s", err)
+	}
+}
+
+func TestFakePushFailure(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	putTestImages(t, src, target)
+	target.Fail("PUT", "/manifests/2", http.StatusInternalServerError, 1)
+
+	result, err := newTestPusher(t, src, target, "2").FakePush(context.Background(), "", "", 1)
+	if err == nil {
+		t.Fatal("FakePush succeeded while the manifest push fails")
+	}
+	if result.Error == "" || len(result.Layers) != 1 {
+		t.Errorf("result does not record the failure after the layer transfer: %+v", result)
+	}
+	if _, ok := target.Manifest("base", "2"); ok {
+		t.Error("new manifest exists after the failed push")
+	}
+}
+
+func TestFakePushRegistries(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	putTestImages(t, src, target)
+
+	registries, err := controller.NewRegistries(map[string]model.RegistryOptions{
+		target.Host(): {Retries: 1, RetryBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistries: %s", err)
+	}
+	retrying := newTestPusher(t, src, target, "2")
+	retrying.Registries = registries
+	plain := newTestPusher(t, src, target, "3")
+
+	// the options of a pusher are its own, not the ones of the last
+	// pusher created
+	target.Fail("PUT", "/manifests/", http.StatusServiceUnavailable, 1)
+	if _, err := retrying.FakePush(context.Background(), "", "", 1); err != nil {
+		t.Errorf("FakePush with retries: %s", err)
+	}
+	target.Fail("PUT", "/manifests/", http.StatusServiceUnavailable, 1)
+	if _, err := plain.FakePush(context.Background(), "", "", 1); err == nil {
+		t.Error("FakePush without retries succeeded while the manifest push fails")
+	}
+}
+
+func TestFakePushRejected(t *testing.T) {
+	src, target := rfptest.NewRegistry(), rfptest.NewRegistry()
+	defer src.Close()
+	defer target.Close()
+	putTestImages(t, src, target)
+	target.Reject("PUT", "/blobs/uploads/", http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content", nil)
+
+	result, err := newTestPusher(t, src, target, "2").FakePush(context.Background(), "", "", 1)
+	if err == nil || !strings.Contains(err.Error(), "DIGEST_INVALID: provided digest did not match uploaded content") {
+		t.Fatalf("error = %v, want the error of the registry", err)
+	}
+	re := result.RegistryError
+	if re == nil || re.StatusCode != http.StatusBadRequest || re.Code != "DIGEST_INVALID" || re.Detail != nil {
+		t.Fatalf("RegistryError = %+v, want the rejected upload", re)
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte(`"registryError":{"action":"upload of blob"`)) {
+		t.Errorf("JSON result %s does not hold the registry error", out)
+	}
+}
+
+func TestFakePushRecompression(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	pusher := newTestPusher(t, reg, reg, "2")
+	pusher.Recompression = &model.Recompression{Compression: model.CompressionZstd}
+	result, err := pusher.FakePush(context.Background(), "", "", 1)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+
+	layer := result.Layers[0]
+	if layer.Mode != model.TransferRecompressed || layer.SourceDigest != blobSum(appLayer).String() {
+		t.Errorf("layer = %+v, want recompressed from %s", layer, blobSum(appLayer))
+	}
+	if m := loadManifest(t, reg, "base", "2"); m.FSLayers[0].BlobSum.String() != layer.Digest {
+		t.Errorf("top layer of new manifest = %s, want %s", m.FSLayers[0].BlobSum, layer.Digest)
+	}
+	if _, ok := reg.Blob("base", layer.Digest); !ok {
+		t.Error("recompressed blob is not pushed")
+	}
+}
+
+func TestFakePushStores(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+
+	// copy the images into memory stores
+	ctx := context.Background()
+	src, target := store.NewMemory(), store.NewMemory()
+	for _, s := range []struct {
+		store      *store.Memory
+		repository string
+		layers     [][]byte
+	}{
+		{src, "app", [][]byte{baseLayer, libLayer, appLayer}},
+		{target, "base", [][]byte{baseLayer}},
+	} {
+		raw, _ := reg.Manifest(s.repository, "1")
+		if _, err := s.store.Manifests().Put(ctx, "1", raw, manifest.ManifestMediaType); err != nil {
+			t.Fatal(err)
+		}
+		for _, layer := range s.layers {
+			if err := s.store.Blobs().Put(ctx, blobSum(layer).String(), bytes.NewReader(layer)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pusher := &RegistryFakePusher{
+		SrcTag:       "1",
+		TargetTag:    "1",
+		NewTags:      []string{"2"},
+		SrcStore:     src,
+		TargetStore:  target,
+		TrustKeyPath: filepath.Join(t.TempDir(), "key.json"),
+	}
+	result, err := pusher.FakePush(ctx, "", "", 1)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+	if result.Layers[0].Mode != model.TransferMounted {
+		t.Errorf("layer is %s, want %s", result.Layers[0].Mode, model.TransferMounted)
+	}
+	if tags, _ := target.Manifests().Tags(ctx); len(tags) != 2 {
+		t.Errorf("tags of target store = %v, want 1 and 2", tags)
+	}
+	if _, exists, _ := target.Blobs().Stat(ctx, blobSum(appLayer).String()); !exists {
+		t.Error("top layer of app is not in target store")
+	}
+	for _, req := range reg.Requests() {
+		if strings.HasSuffix(req.Path, "/manifests/2") {
+			t.Errorf("registry is requested by %s %s", req.Method, req.Path)
+		}
+	}
+}
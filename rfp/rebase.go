@@ -0,0 +1,74 @@
+package rfp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// ResolveImageLocation parses the full reference ref of an image in
+// registry, finding out the scheme the registry is accessed with, given
+// its options in registries.
+func ResolveImageLocation(ctx context.Context, registries *controller.Registries, ref string) (model.ImageLocation, error) {
+	loc, err := model.ParseImageLocation(ref)
+	if err != nil {
+		return loc, err
+	}
+	if loc.Registry, err = addProperScheme(ctx, registries, loc.Registry); err != nil {
+		return loc, err
+	}
+	return loc, nil
+}
+
+// RebaseLayerCount returns the count of the layers the source image has on
+// top of oldBase, whose layers must be the bottom layers of the source image.
+// Overlaying that many layers on the target rebases the source image on it.
+func (r *RegistryFakePusher) RebaseLayerCount(ctx context.Context, oldBase model.ImageLocation, srcJWT, oldBaseJWT string) (int, error) {
+	if r.SrcLocal != nil || r.SrcLayer != nil {
+		return 0, fmt.Errorf("only images in registry can be rebased")
+	}
+
+	sLoc := model.NewImageLocation(r.SrcRegistry, r.SrcRepository, r.SrcTag)
+	sLoc.Digest = r.SrcDigest
+	sMc, err := r.rebaseManifestController(ctx, sLoc, srcJWT)
+	if err != nil {
+		return 0, fmt.Errorf("error create ManifestController for source manifest: %s", err)
+	}
+	bMc, err := r.rebaseManifestController(ctx, oldBase, oldBaseJWT)
+	if err != nil {
+		return 0, fmt.Errorf("error create ManifestController for old base manifest: %s", err)
+	}
+
+	// schema1 lists the layers from the top one
+	layers, baseLayers := sMc.FSLayers, bMc.FSLayers
+	count := len(layers) - len(baseLayers)
+	if count <= 0 {
+		return 0, fmt.Errorf("%s has no layer on top of %s", sLoc, oldBase)
+	}
+	for i, layer := range baseLayers {
+		if layers[count+i].BlobSum != layer.BlobSum {
+			return 0, fmt.Errorf("%s is not built on %s, layer %s differs from %s",
+				sLoc, oldBase, layers[count+i].BlobSum, layer.BlobSum)
+		}
+	}
+	return count, nil
+}
+
+// rebaseManifestController creates the ManifestController of the manifest
+// of loc, authenticated by jwt if any, else like the source image.
+func (r *RegistryFakePusher) rebaseManifestController(ctx context.Context, loc model.ImageLocation, jwt string) (*controller.ManifestController, error) {
+	auth := model.RegistryAuth{Token: jwt}
+	if jwt == "" {
+		var err error
+		if auth, err = r.authenticate(ctx, loc, r.SrcCredentials); err != nil {
+			return nil, err
+		}
+	}
+	rs, err := controller.NewRegistryStore(ctx, loc, auth, r.Registries)
+	if err != nil {
+		return nil, err
+	}
+	return controller.NewStoreManifestController(ctx, rs.Manifests(), loc)
+}
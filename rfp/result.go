@@ -0,0 +1,56 @@
+package rfp
+
+import (
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// Result is the report of a FakePush, durations are in nanoseconds
+// when encoded as JSON.
+type Result struct {
+	// Source, Target and NewReferences are the full references of the images
+	Source        string   `json:"source"`
+	Target        string   `json:"target"`
+	NewReferences []string `json:"newReferences"`
+
+	// Digest is the digest of the pushed manifest of the first new tag
+	Digest string `json:"digest,omitempty"`
+
+	// Digests are the digests of the pushed manifests of NewReferences in
+	// order, they differ as the tag is part of the signed manifest
+	Digests []string `json:"digests,omitempty"`
+
+	// KeyID is the ID of the key signing the pushed manifest
+	KeyID string `json:"keyID,omitempty"`
+
+	// Signature is the reference of the detached signature of the pushed
+	// manifest of the first new tag
+	Signature string `json:"signature,omitempty"`
+
+	// Layers are the overlaid layers, from the bottom one to the top one
+	Layers []LayerResult `json:"layers"`
+
+	Duration     time.Duration `json:"duration"`
+	PushDuration time.Duration `json:"pushDuration"`
+
+	// Error is the reason of the failure, empty if FakePush succeeded
+	Error string `json:"error,omitempty"`
+
+	// RegistryError is the failed response of a registry causing the
+	// failure, if any
+	RegistryError *controller.RegistryError `json:"registryError,omitempty"`
+}
+
+// LayerResult is the report of one overlaid layer
+type LayerResult struct {
+	Digest   string             `json:"digest"`
+	Size     int64              `json:"size"`
+	Mode     model.TransferMode `json:"mode"`
+	Duration time.Duration      `json:"duration"`
+
+	// SourceDigest is the digest of the layer in the source image,
+	// set only if the layer is recompressed into a new blob
+	SourceDigest string `json:"sourceDigest,omitempty"`
+}
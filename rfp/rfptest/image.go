@@ -0,0 +1,108 @@
+package rfptest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+)
+
+// created is the creation time of the images put by PutImage
+var created = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Layer returns a gzip compressed layer tar holding files, which maps
+// the file names to their contents. The same files give the same layer.
+func Layer(files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			ModTime:  created,
+		})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// v1Image is the v1 compatibility json of a layer of the images put by PutImage
+type v1Image struct {
+	ID              string    `json:"id"`
+	Parent          string    `json:"parent,omitempty"`
+	Created         time.Time `json:"created"`
+	Architecture    string    `json:"architecture"`
+	OS              string    `json:"os"`
+	Config          v1Config  `json:"config"`
+	ContainerConfig v1Config  `json:"container_config"`
+}
+
+type v1Config struct {
+	Env []string `json:"Env"`
+	Cmd []string `json:"Cmd"`
+}
+
+// PutImage stores a schema1 image signed by TrustKey in repository under
+// tag, with layers from the bottom one to the top one and env as the
+// environment of every layer. The digest of the manifest is returned.
+func (r *Registry) PutImage(repository, tag string, env []string, layers ...[]byte) (string, error) {
+	if len(layers) == 0 {
+		return "", fmt.Errorf("at least one layer is needed")
+	}
+
+	m := manifest.Manifest{
+		Name:         repository,
+		Tag:          tag,
+		Architecture: "amd64",
+	}
+	m.SchemaVersion = 1
+
+	parent := ""
+	for _, layer := range layers {
+		blobSum := r.PutBlob(repository, layer)
+
+		// the ids are derived from the layers, so the same layers give the same image
+		id, _ := digest.FromBytes([]byte(parent + blobSum))
+		config := v1Config{Env: env, Cmd: []string{"/bin/sh"}}
+		v1, err := json.Marshal(v1Image{
+			ID:              id.Hex(),
+			Parent:          parent,
+			Created:         created,
+			Architecture:    "amd64",
+			OS:              "linux",
+			Config:          config,
+			ContainerConfig: config,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		// schema1 lists the layers from the top one
+		m.FSLayers = append([]manifest.FSLayer{{BlobSum: digest.Digest(blobSum)}}, m.FSLayers...)
+		m.History = append([]manifest.History{{V1Compatibility: string(v1)}}, m.History...)
+		parent = id.Hex()
+	}
+
+	signed, err := manifest.Sign(&m, r.TrustKey)
+	if err != nil {
+		return "", err
+	}
+	return r.PutManifest(repository, tag, signed.Raw, manifest.ManifestMediaType), nil
+}
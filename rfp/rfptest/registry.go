@@ -0,0 +1,584 @@
+// Package rfptest provides an in-process registry for the tests of
+// registry-fake-pusher, speaking enough of the registry v2 API for the
+// controllers: blobs, uploads, cross repository mounts, manifests, tags
+// and the token endpoint, with switchable authentication and injectable
+// failures.
+package rfptest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/libtrust"
+)
+
+// AuthMode is the authentication the Registry requires
+type AuthMode int
+
+const (
+	// AuthNone accepts all the requests
+	AuthNone AuthMode = iota
+
+	// AuthBearer requires the tokens issued by the token endpoint of the
+	// Registry, which checks the basic auth credentials if any are set
+	AuthBearer
+
+	// AuthBasic requires the basic auth credentials on every request
+	AuthBasic
+)
+
+// tokenService is the service of the bearer challenge
+const tokenService = "rfptest"
+
+// Request is a request served by the Registry
+type Request struct {
+	Method string
+	Path   string
+	Status int
+}
+
+// failure makes the matching requests fail
+type failure struct {
+	method, path string
+	status       int
+	count        int
+
+	// body is the error envelope answered, if any
+	body []byte
+}
+
+// upload is an upload session of a blob
+type upload struct {
+	repository string
+	content    bytes.Buffer
+}
+
+// storedManifest is a manifest stored in the Registry
+type storedManifest struct {
+	content   []byte
+	mediaType string
+	digest    string
+}
+
+// Registry is an in-process registry keeping everything in memory,
+// it is safe for concurrent use.
+type Registry struct {
+	server *httptest.Server
+
+	// TrustKey is the key signing the images put by PutImage
+	TrustKey libtrust.PrivateKey
+
+	mu                 sync.Mutex
+	auth               AuthMode
+	username, password string
+	tokens             map[string]bool
+	blobs              map[string]map[string][]byte
+	manifests          map[string]map[string]storedManifest
+	uploads            map[string]*upload
+	nextUpload         int
+	failures           []*failure
+	omitDigest         map[string]bool
+	requests           []Request
+}
+
+// NewRegistry starts a Registry without authentication,
+// which must be closed by the caller.
+func NewRegistry() *Registry {
+	return newRegistry(httptest.NewServer)
+}
+
+// NewTLSRegistry starts a Registry like NewRegistry, served over HTTPS
+// with the self-signed Certificate.
+func NewTLSRegistry() *Registry {
+	return newRegistry(httptest.NewTLSServer)
+}
+
+func newRegistry(newServer func(http.Handler) *httptest.Server) *Registry {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		panic(fmt.Sprintf("rfptest: error generate trust key: %s", err))
+	}
+
+	r := &Registry{
+		TrustKey:   key,
+		tokens:     make(map[string]bool),
+		blobs:      make(map[string]map[string][]byte),
+		manifests:  make(map[string]map[string]storedManifest),
+		uploads:    make(map[string]*upload),
+		omitDigest: make(map[string]bool),
+	}
+	r.server = newServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// Certificate returns the certificate of a Registry served over HTTPS
+// in PEM format, nil otherwise.
+func (r *Registry) Certificate() []byte {
+	cert := r.server.Certificate()
+	if cert == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// URL returns the base URL of the Registry, like http://127.0.0.1:port
+func (r *Registry) URL() string {
+	return r.server.URL
+}
+
+// Host returns the host and port of the Registry, as used in image references
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "http://"), "https://")
+}
+
+// Close shuts down the Registry
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// SetAuth switches the authentication of the Registry, username and
+// password are the credentials accepted, any are if both are empty.
+func (r *Registry) SetAuth(mode AuthMode, username, password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.auth = mode
+	r.username, r.password = username, password
+}
+
+// WriteDockerConfig writes a docker config file into a new directory of
+// t, holding username and password as the credentials of each of
+// registries, and returns the directory.
+func WriteDockerConfig(t testing.TB, username, password string, registries ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	var auths []string
+	for _, registry := range registries {
+		auths = append(auths, fmt.Sprintf(`%q: {"auth": %q}`, registry, auth))
+	}
+	config := fmt.Sprintf(`{"auths": {%s}}`, strings.Join(auths, ", "))
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Fail makes the next count requests of method, whose path contains path,
+// fail with status. All of them fail if count is negative.
+func (r *Registry) Fail(method, path string, status, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures = append(r.failures, &failure{method: method, path: path, status: status, count: count})
+}
+
+// Reject makes the next request of method, whose path contains path, fail
+// with status and the error envelope of the distribution API holding code,
+// message and detail.
+func (r *Registry) Reject(method, path string, status int, code, message string, detail interface{}) {
+	body, _ := json.Marshal(errorEnvelope(code, message, detail))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, &failure{method: method, path: path, status: status, count: 1, body: body})
+}
+
+// OmitDigest makes the manifest responses to method leave out the
+// Docker-Content-Digest header, like some registries and proxies do to HEAD.
+func (r *Registry) OmitDigest(method string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.omitDigest[method] = true
+}
+
+// Requests returns the requests served so far, in order
+func (r *Registry) Requests() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Request(nil), r.requests...)
+}
+
+// Blob returns the content of the blob dgst in repository
+func (r *Registry) Blob(repository, dgst string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	content, ok := r.blobs[repository][dgst]
+	return content, ok
+}
+
+// PutBlob stores content in repository as a blob, returning its digest
+func (r *Registry) PutBlob(repository string, content []byte) string {
+	dgst, _ := digest.FromBytes(content)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.putBlob(repository, dgst.String(), content)
+	return dgst.String()
+}
+
+// Manifest returns the manifest of repository by tag or digest
+func (r *Registry) Manifest(repository, ref string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.manifests[repository][ref]
+	return m.content, ok
+}
+
+// PutManifest stores the manifest in repository under ref, a tag or its
+// digest, returning the digest of the manifest.
+func (r *Registry) PutManifest(repository, ref string, content []byte, mediaType string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.putManifest(repository, ref, content, mediaType)
+}
+
+func (r *Registry) putBlob(repository, dgst string, content []byte) {
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = make(map[string][]byte)
+	}
+	r.blobs[repository][dgst] = content
+}
+
+// putManifest stores the manifest, whose digest is the one of the payload
+// for signed schema1 manifests, like the registry does.
+func (r *Registry) putManifest(repository, ref string, content []byte, mediaType string) string {
+	payload := content
+	if jsig, err := libtrust.ParsePrettySignature(content, "signatures"); err == nil {
+		if p, err := jsig.Payload(); err == nil {
+			payload = p
+		}
+	}
+	dgst, _ := digest.FromBytes(payload)
+
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = make(map[string]storedManifest)
+	}
+	m := storedManifest{content: content, mediaType: mediaType, digest: dgst.String()}
+	r.manifests[repository][dgst.String()] = m
+	if ref != dgst.String() {
+		r.manifests[repository][ref] = m
+	}
+	return dgst.String()
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		r.mu.Lock()
+		r.requests = append(r.requests, Request{Method: req.Method, Path: req.URL.Path, Status: rec.status})
+		r.mu.Unlock()
+	}()
+
+	if f, ok := r.injectedFailure(req); ok {
+		if f.body == nil {
+			http.Error(rec, http.StatusText(f.status), f.status)
+			return
+		}
+		rec.Header().Set("Content-Type", "application/json")
+		rec.WriteHeader(f.status)
+		rec.Write(f.body)
+		return
+	}
+
+	if req.URL.Path == "/token" {
+		r.serveToken(rec, req)
+		return
+	}
+	if !r.authorized(rec, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.URL.Path == "/v2/":
+		rec.WriteHeader(http.StatusOK)
+	case strings.HasSuffix(path, "/tags/list"):
+		r.serveTags(rec, req, strings.TrimSuffix(path, "/tags/list"))
+	case strings.Contains(path, "/blobs/uploads/"):
+		i := strings.Index(path, "/blobs/uploads/")
+		r.serveUpload(rec, req, path[:i], path[i+len("/blobs/uploads/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(rec, req, path[:i], path[i+len("/blobs/"):])
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(rec, req, path[:i], path[i+len("/manifests/"):])
+	default:
+		http.NotFound(rec, req)
+	}
+}
+
+// injectedFailure returns the failure the request must fail with, if any
+func (r *Registry) injectedFailure(req *http.Request) (*failure, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.failures {
+		if f.count == 0 || f.method != req.Method || !strings.Contains(req.URL.Path, f.path) {
+			continue
+		}
+		if f.count > 0 {
+			f.count--
+		}
+		return f, true
+	}
+	return nil, false
+}
+
+// authorized checks the credentials of the request, challenging the
+// client if they are missing or wrong.
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	auth := req.Header.Get("Authorization")
+	switch r.auth {
+	case AuthBearer:
+		if strings.HasPrefix(auth, "Bearer ") && r.tokens[strings.TrimPrefix(auth, "Bearer ")] {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Bearer realm="%s/token",service="%s"`, r.server.URL, tokenService))
+	case AuthBasic:
+		if username, password, ok := req.BasicAuth(); ok && r.validCredentials(username, password) {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="rfptest"`)
+	default:
+		return true
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+func (r *Registry) validCredentials(username, password string) bool {
+	if r.username == "" && r.password == "" {
+		return true
+	}
+	return username == r.username && password == r.password
+}
+
+// serveToken issues a token if the basic auth credentials are valid
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	username, password, _ := req.BasicAuth()
+	if req.URL.Query().Get("service") != tokenService || !r.validCredentials(username, password) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	token := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s:%d",
+		username, req.URL.Query().Get("scope"), len(r.tokens))))
+	r.tokens[token] = true
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repository, dgst string) {
+	content, ok := r.Blob(repository, dgst)
+	if !ok {
+		http.Error(w, "blob unknown", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "HEAD", "GET":
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			w.Write(content)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == "" {
+		if req.Method != "POST" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		query := req.URL.Query()
+		if mount, from := query.Get("mount"), query.Get("from"); mount != "" {
+			if content, ok := r.blobs[from][mount]; ok {
+				r.putBlob(repository, mount, content)
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repository, mount))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+
+		r.nextUpload++
+		id = strconv.Itoa(r.nextUpload)
+		r.uploads[id] = &upload{repository: repository}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	u, ok := r.uploads[id]
+	if !ok || u.repository != repository {
+		http.Error(w, "blob upload unknown", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "PATCH", "PUT":
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.content.Write(content)
+		if req.Method == "PATCH" {
+			w.Header().Set("Location", req.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		dgst, err := digest.FromBytes(u.content.Bytes())
+		if err != nil || dgst.String() != req.URL.Query().Get("digest") {
+			http.Error(w, "digest invalid", http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, id)
+		r.putBlob(repository, dgst.String(), u.content.Bytes())
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch req.Method {
+	case "HEAD", "GET":
+		m, ok := r.manifests[repository][ref]
+		if !ok {
+			http.Error(w, "manifest unknown", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		if !r.omitDigest[req.Method] {
+			w.Header().Set("Docker-Content-Digest", m.digest)
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			w.Write(m.content)
+		}
+	case "PUT":
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mediaType := req.Header.Get("Content-Type")
+		if mediaType == "" {
+			mediaType = manifest.ManifestMediaType
+		}
+		// like registry, the tag of a schema1 manifest must be the one
+		// it is pushed as
+		var versioned struct {
+			Tag string `json:"tag"`
+		}
+		json.Unmarshal(content, &versioned)
+		if _, err := digest.ParseDigest(ref); err != nil && versioned.Tag != "" && versioned.Tag != ref {
+			writeJSON(w, http.StatusBadRequest, errorEnvelope("TAG_INVALID", "manifest tag did not match URI",
+				map[string]string{"tag": versioned.Tag, "reference": ref}))
+			return
+		}
+		dgst := r.putManifest(repository, ref, content, mediaType)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repository, dgst))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTags lists the tags of the repository, paginated by n and last
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	r.mu.Lock()
+	tags := []string{}
+	for ref, m := range r.manifests[repository] {
+		if ref != m.digest {
+			tags = append(tags, ref)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(tags)
+
+	query := req.URL.Query()
+	if last := query.Get("last"); last != "" {
+		i := sort.SearchStrings(tags, last)
+		if i < len(tags) && tags[i] == last {
+			i++
+		}
+		tags = tags[i:]
+	}
+	if n, err := strconv.Atoi(query.Get("n")); err == nil && n > 0 && n < len(tags) {
+		tags = tags[:n]
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {tags[n-1]}}
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?%s>; rel="next"`, repository, next.Encode()))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": repository, "tags": tags})
+}
+
+// errorEnvelope is the error envelope of the distribution API
+func errorEnvelope(code, message string, detail interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"errors": []map[string]interface{}{{"code": code, "message": message, "detail": detail}},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusRecorder records the status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// JobStatus is the status of a Job
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Credentials are the credentials of a registry given in a request, either
+// a token or a username and password. The credentials in the docker config
+// file of the server are used if empty. They are never persisted.
+type Credentials struct {
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// jwt returns the token of the credentials, if any
+func (c *Credentials) jwt() string {
+	if c == nil {
+		return ""
+	}
+	return c.Token
+}
+
+// authConfig returns the username and password of the credentials,
+// nil if they are not given.
+func (c *Credentials) authConfig() *model.AuthConfig {
+	if c == nil || c.Token != "" || c.Username == "" {
+		return nil
+	}
+	return &model.AuthConfig{Username: c.Username, Password: c.Password}
+}
+
+// PushOptions are the options of a request pushing a new image
+type PushOptions struct {
+	// NewReferences are bare tags or full references in the repository of the target
+	NewReferences []string `json:"newReferences"`
+
+	Force          bool   `json:"force,omitempty"`
+	ExpectedDigest string `json:"expectedDigest,omitempty"`
+
+	// SkipVerify is refused unless the Server allows it
+	SkipVerify bool `json:"skipVerify,omitempty"`
+
+	// Compression is the compression the layers are converted to, like zstd or gzip:9
+	Compression string `json:"compression,omitempty"`
+
+	SourceCredentials *Credentials `json:"sourceCredentials,omitempty"`
+	TargetCredentials *Credentials `json:"targetCredentials,omitempty"`
+}
+
+// valid checks the options of a request whose target is target.
+func (o *PushOptions) valid(target string) error {
+	if len(o.NewReferences) == 0 {
+		return fmt.Errorf("at least one new reference is needed")
+	}
+	if _, err := rfp.ParseNewTags(target, o.NewReferences); err != nil {
+		return err
+	}
+	if o.Compression != "" {
+		if _, err := model.ParseRecompression(o.Compression); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply sets the options on pusher.
+func (o *PushOptions) apply(pusher *rfp.RegistryFakePusher) {
+	pusher.Force = o.Force
+	pusher.ExpectedDigest = o.ExpectedDigest
+	pusher.SkipVerify = o.SkipVerify
+	if o.Compression != "" {
+		rc, _ := model.ParseRecompression(o.Compression)
+		pusher.Recompression = &rc
+	}
+}
+
+// OverlayRequest overlays the top layers of Source on Target
+type OverlayRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+
+	// Layers is the count of the layers of Source to overlay, 1 if 0
+	Layers int `json:"layers,omitempty"`
+
+	PushOptions
+}
+
+func (or *OverlayRequest) valid() error {
+	if or.Source == "" || or.Target == "" {
+		return fmt.Errorf("source and target are required")
+	}
+	if err := validSource(or.Source); err != nil {
+		return err
+	}
+	if or.Layers < 0 {
+		return fmt.Errorf("layers must be at least 1")
+	}
+	if or.Layers == 0 {
+		or.Layers = 1
+	}
+	return or.PushOptions.valid(or.Target)
+}
+
+// RebaseRequest moves the layers Image has on top of OldBase onto NewBase.
+// OldBase is read with the source credentials, like Image.
+type RebaseRequest struct {
+	Image   string `json:"image"`
+	OldBase string `json:"oldBase"`
+	NewBase string `json:"newBase"`
+
+	PushOptions
+}
+
+func (rr *RebaseRequest) valid() error {
+	if rr.Image == "" || rr.OldBase == "" || rr.NewBase == "" {
+		return fmt.Errorf("image, oldBase and newBase are required")
+	}
+	if err := validSource(rr.Image); err != nil {
+		return err
+	}
+	return rr.PushOptions.valid(rr.NewBase)
+}
+
+// Job is an overlay or rebase run asynchronously by the Server
+type Job struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+
+	// Overlay or Rebase is the request of the job, without the credentials
+	Overlay *OverlayRequest `json:"overlay,omitempty"`
+	Rebase  *RebaseRequest  `json:"rebase,omitempty"`
+
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	// Result is the report of the push, set once the job is finished
+	Result *rfp.Result `json:"result,omitempty"`
+
+	// Error is the reason of the failure of the job
+	Error string `json:"error,omitempty"`
+
+	// credentials are kept out of the persisted request
+	srcCredentials, targetCredentials *Credentials
+}
+
+func newJob(overlay *OverlayRequest, rebase *RebaseRequest) *Job {
+	job := &Job{ID: newJobID(), Status: JobQueued, Created: time.Now().UTC()}
+	var opts *PushOptions
+	if overlay != nil {
+		req := *overlay
+		job.Overlay, opts = &req, &req.PushOptions
+	} else {
+		req := *rebase
+		job.Rebase, opts = &req, &req.PushOptions
+	}
+	job.srcCredentials, job.targetCredentials = opts.SourceCredentials, opts.TargetCredentials
+	opts.SourceCredentials, opts.TargetCredentials = nil, nil
+	return job
+}
+
+func newJobID() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// finished tells whether the job is done, successfully or not
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobStore keeps the jobs in memory, and also in the file path if set,
+// which is rewritten on every change so the jobs survive a restart.
+// Finished jobs are dropped once older than retention, if not zero.
+type jobStore struct {
+	path      string
+	retention time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// newJobStore creates a jobStore loading the jobs of path, the jobs
+// which did not finish before the restart are failed.
+func newJobStore(path string, retention time.Duration) (*jobStore, error) {
+	js := &jobStore{path: path, retention: retention, jobs: make(map[string]*Job)}
+	if path == "" {
+		return js, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return js, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("error parse jobs from %s: %s", path, err)
+	}
+
+	now := time.Now().UTC()
+	for _, job := range jobs {
+		if !job.finished() {
+			job.Status = JobFailed
+			job.Error = "interrupted by a restart of the server"
+			job.Finished = &now
+		}
+		js.jobs[job.ID] = job
+	}
+	return js, js.save()
+}
+
+// add stores the new job
+func (js *jobStore) add(job *Job) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.jobs[job.ID] = job
+	return js.save()
+}
+
+// update changes the job id by f, it is persisted as well.
+func (js *jobStore) update(id string, f func(job *Job)) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	f(job)
+	return js.save()
+}
+
+// remove drops the job id, like one never queued
+func (js *jobStore) remove(id string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	delete(js.jobs, id)
+	return js.save()
+}
+
+// marshal returns the job id encoded as JSON
+func (js *jobStore) marshal(id string) ([]byte, bool, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := json.Marshal(job)
+	return data, true, err
+}
+
+// save drops the expired jobs and writes the others into path,
+// it must be called with mu held.
+func (js *jobStore) save() error {
+	if js.retention > 0 {
+		expiry := time.Now().Add(-js.retention)
+		for id, job := range js.jobs {
+			if job.finished() && job.Finished != nil && job.Finished.Before(expiry) {
+				delete(js.jobs, id)
+			}
+		}
+	}
+	if js.path == "" {
+		return nil
+	}
+
+	jobs := make([]*Job, 0, len(js.jobs))
+	for _, job := range js.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(js.path), ".jobs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), js.path)
+}
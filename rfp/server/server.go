@@ -0,0 +1,349 @@
+// Package server exposes RegistryFakePusher as a REST API, the overlays
+// and rebases requested are queued and run asynchronously as jobs:
+//
+//	POST /v1/overlay    queues an OverlayRequest
+//	POST /v1/rebase     queues a RebaseRequest
+//	GET  /v1/jobs/{id}  returns the Job
+//	GET  /metrics       returns the metrics in Prometheus text format
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/metrics"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+const (
+	// maxRequestSize bounds the body of the requests
+	maxRequestSize = 1 << 20
+
+	jobsPath = "/v1/jobs/"
+)
+
+// Options are the options of a Server
+type Options struct {
+	// Workers is the count of the jobs run at the same time, 1 if 0
+	Workers int
+
+	// QueueSize is the count of the jobs waiting to run, beyond which
+	// the requests are refused, 16 if 0
+	QueueSize int
+
+	// StatePath, if set, is the file the jobs are persisted in,
+	// they are only kept in memory otherwise
+	StatePath string
+
+	// Retention is how long finished jobs are kept, forever if 0
+	Retention time.Duration
+
+	// JobTimeout, if not zero, bounds the run of each job
+	JobTimeout time.Duration
+
+	// Registries are the options of the connections to the registries
+	// of the jobs, the default ones are used if nil
+	Registries *controller.Registries
+
+	// AllowSkipVerify lets the requests disable the verification of the
+	// signatures with skipVerify, such requests are refused otherwise
+	AllowSkipVerify bool
+
+	// Configure, if set, applies the options of the server, like the trust
+	// key, to the RegistryFakePusher of every job
+	Configure func(pusher *rfp.RegistryFakePusher)
+
+	// Logger logs the jobs, with their id as request id, and the
+	// pushes they run. The messages of at least info level are written
+	// to stderr if nil.
+	Logger *log.Logger
+}
+
+// Server runs the jobs requested through its HTTP API
+type Server struct {
+	opts  Options
+	jobs  *jobStore
+	queue chan *Job
+	mux   *http.ServeMux
+	wg    sync.WaitGroup
+}
+
+// New creates a Server, loading the jobs persisted in StatePath.
+func New(opts Options) (*Server, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 16
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.FromContext(context.Background())
+	}
+
+	jobs, err := newJobStore(opts.StatePath, opts.Retention)
+	if err != nil {
+		return nil, fmt.Errorf("error load jobs: %s", err)
+	}
+
+	s := &Server{
+		opts:  opts,
+		jobs:  jobs,
+		queue: make(chan *Job, opts.QueueSize),
+		mux:   http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/overlay", allowMethod(http.MethodPost, s.handleOverlay))
+	s.mux.HandleFunc("/v1/rebase", allowMethod(http.MethodPost, s.handleRebase))
+	s.mux.HandleFunc(jobsPath, allowMethod(http.MethodGet, s.handleJob))
+	s.mux.Handle("/metrics", metrics.Default.Handler())
+	return s, nil
+}
+
+// Start starts the workers running the queued jobs until ctx is done,
+// the running jobs are aborted then.
+func (s *Server) Start(ctx context.Context) {
+	for i := 0; i < s.opts.Workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-s.queue:
+					s.run(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+// Wait waits for the workers to stop once the context of Start is done
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleOverlay(w http.ResponseWriter, r *http.Request) {
+	var req OverlayRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := req.valid(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.allowed(&req.PushOptions); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	s.enqueue(w, newJob(&req, nil))
+}
+
+func (s *Server) handleRebase(w http.ResponseWriter, r *http.Request) {
+	var req RebaseRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := req.valid(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.allowed(&req.PushOptions); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	s.enqueue(w, newJob(nil, &req))
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, jobsPath)
+	data, ok, err := s.jobs.marshal(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// enqueue queues job, which is refused if the queue is full.
+func (s *Server) enqueue(w http.ResponseWriter, job *Job) {
+	if err := s.jobs.add(job); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	select {
+	case s.queue <- job:
+	default:
+		s.jobs.remove(job.ID)
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("too many jobs queued, retry later"))
+		return
+	}
+	s.jobLogger(job).Infof("job queued")
+
+	data, _, err := s.jobs.marshal(job.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jobsPath+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// run runs job, recording its status and result.
+func (s *Server) run(ctx context.Context, job *Job) {
+	started := time.Now().UTC()
+	s.update(job.ID, func(j *Job) {
+		j.Status = JobRunning
+		j.Started = &started
+	})
+	logger := s.jobLogger(job)
+	logger.Infof("job started")
+
+	result, err := s.push(log.NewContext(ctx, logger), job)
+
+	finished := time.Now().UTC()
+	s.update(job.ID, func(j *Job) {
+		j.Finished = &finished
+		j.Result = result
+		j.Status = JobSucceeded
+		if err != nil {
+			j.Status = JobFailed
+			j.Error = err.Error()
+		}
+	})
+	logger = logger.WithField(log.FieldDuration, log.Duration(finished.Sub(started)))
+	if err != nil {
+		logger.WithError(err).Warnf("job failed")
+		return
+	}
+	logger.WithField(log.FieldDigest, result.Digest).Infof("job succeeded")
+}
+
+func (s *Server) update(id string, f func(job *Job)) {
+	if err := s.jobs.update(id, f); err != nil {
+		s.opts.Logger.WithField(log.FieldRequestID, id).Warnf("error persist job: %s", err)
+	}
+}
+
+// jobLogger returns the Logger of the server with the id of job as request id
+func (s *Server) jobLogger(job *Job) *log.Logger {
+	return s.opts.Logger.WithField(log.FieldRequestID, job.ID)
+}
+
+// push runs the overlay or rebase of job.
+func (s *Server) push(ctx context.Context, job *Job) (*rfp.Result, error) {
+	if s.opts.JobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.JobTimeout)
+		defer cancel()
+	}
+
+	var src, target string
+	var opts *PushOptions
+	layers := 0
+	if job.Overlay != nil {
+		src, target, layers, opts = job.Overlay.Source, job.Overlay.Target, job.Overlay.Layers, &job.Overlay.PushOptions
+	} else {
+		src, target, opts = job.Rebase.Image, job.Rebase.NewBase, &job.Rebase.PushOptions
+	}
+
+	// the jobs reloaded from StatePath may predate the options of the server
+	if err := s.allowed(opts); err != nil {
+		return nil, err
+	}
+	tags, err := rfp.ParseNewTags(target, opts.NewReferences)
+	if err != nil {
+		return nil, err
+	}
+	pusher, err := rfp.NewRegistryFakePusherFromReferences(ctx, s.opts.Registries, src, target, tags...)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.Configure != nil {
+		s.opts.Configure(pusher)
+	}
+	opts.apply(pusher)
+
+	pusher.SrcCredentials = job.srcCredentials.authConfig()
+	pusher.TargetCredentials = job.targetCredentials.authConfig()
+	srcJWT, targetJWT := job.srcCredentials.jwt(), job.targetCredentials.jwt()
+
+	if job.Rebase != nil {
+		oldBase, err := rfp.ResolveImageLocation(ctx, s.opts.Registries, job.Rebase.OldBase)
+		if err != nil {
+			return nil, err
+		}
+		if layers, err = pusher.RebaseLayerCount(ctx, oldBase, srcJWT, srcJWT); err != nil {
+			return nil, err
+		}
+	}
+
+	return pusher.FakePush(ctx, srcJWT, targetJWT, layers)
+}
+
+// decodeRequest decodes the JSON body of r into v, replying the
+// error if it is invalid.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+		return false
+	}
+	return true
+}
+
+// allowMethod refuses the requests to h not using method
+func allowMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// allowed checks opts against the options of the server, which the
+// requests must not weaken.
+func (s *Server) allowed(opts *PushOptions) error {
+	if opts.SkipVerify && !s.opts.AllowSkipVerify {
+		return fmt.Errorf("skipVerify is not allowed by the server")
+	}
+	return nil
+}
+
+// validSource refuses local images, the files of the server must not
+// be read on request.
+func validSource(ref string) error {
+	if _, ok := model.ParseLocalSource(ref); ok {
+		return fmt.Errorf("local image %s is not supported by the server", ref)
+	}
+	return nil
+}
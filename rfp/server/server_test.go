@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+)
+
+var (
+	baseLayer = rfptest.Layer(map[string]string{"etc/os-release": "base"})
+	newLayer  = rfptest.Layer(map[string]string{"etc/os-release": "new base"})
+	appLayer  = rfptest.Layer(map[string]string{"usr/bin/app": "app"})
+)
+
+// newTestServer starts a Server with its workers, and a registry holding
+// app:1 built on base:1, and base:2.
+func newTestServer(t *testing.T, opts Options) (*httptest.Server, *rfptest.Registry) {
+	reg := rfptest.NewRegistry()
+	t.Cleanup(reg.Close)
+	if _, err := reg.PutImage("app", "1", nil, baseLayer, appLayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.PutImage("base", "1", nil, baseLayer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.PutImage("base", "2", nil, newLayer); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(t.TempDir(), "key.json")
+	opts.Configure = func(pusher *rfp.RegistryFakePusher) {
+		pusher.TrustKeyPath = keyPath
+	}
+	srv, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		srv.Wait()
+	})
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return ts, reg
+}
+
+func post(t *testing.T, url string, v interface{}) (*http.Response, []byte) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, body
+}
+
+// waitJob polls the job at location until it is finished
+func waitJob(t *testing.T, baseURL, location string) Job {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(baseURL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var job Job
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.finished() {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s not finished in time", location)
+	return Job{}
+}
+
+func TestOverlayJob(t *testing.T) {
+	ts, reg := newTestServer(t, Options{})
+
+	resp, body := post(t, ts.URL+"/v1/overlay", map[string]interface{}{
+		"source":        reg.Host() + "/app:1",
+		"target":        reg.Host() + "/base:1",
+		"newReferences": []string{"app"},
+		"targetCredentials": map[string]string{
+			"token": "secret",
+		},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, body)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/v1/jobs/") {
+		t.Fatalf("Location = %q", location)
+	}
+	if strings.Contains(string(body), "secret") {
+		t.Errorf("credentials returned in %s", body)
+	}
+
+	job := waitJob(t, ts.URL, location)
+	if job.Status != JobSucceeded {
+		t.Fatalf("status = %s, error %q", job.Status, job.Error)
+	}
+	if job.Result == nil || job.Result.Digest == "" {
+		t.Errorf("no result in %+v", job)
+	}
+	if _, ok := reg.Manifest("base", "app"); !ok {
+		t.Error("base:app not pushed")
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, name := range []string{"rfp_manifest_pushes_total{result=\"success\"}", "rfp_manifest_push_duration_seconds_count", "rfp_blob_transfers_total"} {
+		if !strings.Contains(string(metrics), name) {
+			t.Errorf("%s not in metrics:\n%s", name, metrics)
+		}
+	}
+}
+
+func TestRebaseJob(t *testing.T) {
+	ts, reg := newTestServer(t, Options{})
+
+	resp, body := post(t, ts.URL+"/v1/rebase", map[string]interface{}{
+		"image":         reg.Host() + "/app:1",
+		"oldBase":       reg.Host() + "/base:1",
+		"newBase":       reg.Host() + "/base:2",
+		"newReferences": []string{"rebased"},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, body)
+	}
+	job := waitJob(t, ts.URL, resp.Header.Get("Location"))
+	if job.Status != JobSucceeded {
+		t.Fatalf("status = %s, error %q", job.Status, job.Error)
+	}
+	if len(job.Result.Layers) != 1 {
+		t.Errorf("%d layers overlaid, want 1", len(job.Result.Layers))
+	}
+
+	// base:2 is not the base of app:1
+	resp, _ = post(t, ts.URL+"/v1/rebase", map[string]interface{}{
+		"image":         reg.Host() + "/app:1",
+		"oldBase":       reg.Host() + "/base:2",
+		"newBase":       reg.Host() + "/base:1",
+		"newReferences": []string{"wrong"},
+	})
+	job = waitJob(t, ts.URL, resp.Header.Get("Location"))
+	if job.Status != JobFailed || !strings.Contains(job.Error, "is not built on") {
+		t.Errorf("status = %s, error %q, want failed as not built on", job.Status, job.Error)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	ts, reg := newTestServer(t, Options{})
+
+	for _, tc := range []struct {
+		path string
+		body interface{}
+	}{
+		{"/v1/overlay", map[string]interface{}{"target": reg.Host() + "/base:1", "newReferences": []string{"x"}}},
+		{"/v1/overlay", map[string]interface{}{"source": "oci:/tmp/layout", "target": reg.Host() + "/base:1", "newReferences": []string{"x"}}},
+		{"/v1/overlay", map[string]interface{}{"source": reg.Host() + "/app:1", "target": reg.Host() + "/base:1"}},
+		{"/v1/overlay", map[string]interface{}{"source": reg.Host() + "/app:1", "target": reg.Host() + "/base:1", "newReferences": []string{"x"}, "compression": "lz4"}},
+		{"/v1/overlay", map[string]interface{}{"source": reg.Host() + "/app:1", "target": reg.Host() + "/base:1", "newReferences": []string{"x"}, "unknown": true}},
+		{"/v1/rebase", map[string]interface{}{"image": reg.Host() + "/app:1", "newBase": reg.Host() + "/base:2", "newReferences": []string{"x"}}},
+	} {
+		resp, body := post(t, ts.URL+tc.path, tc.body)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: status = %d, want %d", tc.body, resp.StatusCode, http.StatusBadRequest)
+		}
+		var e map[string]string
+		if err := json.Unmarshal(body, &e); err != nil || e["error"] == "" {
+			t.Errorf("%v: no error in %s", tc.body, body)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/jobs/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestSkipVerify(t *testing.T) {
+	request := func(reg *rfptest.Registry) map[string]interface{} {
+		return map[string]interface{}{
+			"source":        reg.Host() + "/app:1",
+			"target":        reg.Host() + "/base:1",
+			"newReferences": []string{"unverified"},
+			"skipVerify":    true,
+		}
+	}
+
+	ts, reg := newTestServer(t, Options{})
+	if resp, body := post(t, ts.URL+"/v1/overlay", request(reg)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+	}
+
+	ts, reg = newTestServer(t, Options{AllowSkipVerify: true})
+	resp, body := post(t, ts.URL+"/v1/overlay", request(reg))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, body)
+	}
+	if job := waitJob(t, ts.URL, resp.Header.Get("Location")); job.Status != JobSucceeded {
+		t.Errorf("job = %+v, want succeeded", job)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	// the workers are not started, so the jobs stay queued
+	srv, err := New(Options{QueueSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	req := map[string]interface{}{
+		"source":        "registry.example.com/app:1",
+		"target":        "registry.example.com/base:1",
+		"newReferences": []string{"2"},
+	}
+	resp, body := post(t, ts.URL+"/v1/overlay", req)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, body)
+	}
+	resp, _ = post(t, ts.URL+"/v1/overlay", req)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if n := len(srv.jobs.jobs); n != 1 {
+		t.Errorf("%d jobs kept, want 1", n)
+	}
+}
+
+func TestStateReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	srv, err := New(Options{StatePath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := newJob(&OverlayRequest{
+		Source: "registry.example.com/app:1",
+		Target: "registry.example.com/base:1",
+		PushOptions: PushOptions{
+			NewReferences:     []string{"2"},
+			SourceCredentials: &Credentials{Username: "user", Password: "secret"},
+		},
+	}, nil)
+	if err := srv.jobs.add(job); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("credentials persisted in %s", data)
+	}
+
+	srv, err = New(Options{StatePath: path})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reloaded, ok := srv.jobs.jobs[job.ID]
+	if !ok {
+		t.Fatalf("job %s not reloaded", job.ID)
+	}
+	if reloaded.Status != JobFailed || reloaded.Finished == nil {
+		t.Errorf("status = %s, want the queued job failed", reloaded.Status)
+	}
+	if reloaded.Overlay == nil || reloaded.Overlay.Source != job.Overlay.Source {
+		t.Errorf("request not reloaded: %+v", reloaded.Overlay)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	js, err := newJobStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	js.add(&Job{ID: "old", Status: JobSucceeded, Finished: &old})
+	js.add(&Job{ID: "queued", Status: JobQueued})
+	if _, ok, _ := js.marshal("old"); ok {
+		t.Error("expired job kept")
+	}
+	if _, ok, _ := js.marshal("queued"); !ok {
+		t.Error("unfinished job dropped")
+	}
+}
@@ -0,0 +1,39 @@
+package rfp
+
+import (
+	"context"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/controller"
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+	"github.com/laincloud/registry-fake-pusher/rfp/utils"
+)
+
+// VerifySignature checks the detached signature of the image ref is made by
+// the public key at keyPath, returning the digest of the verified manifest.
+// The registry is accessed with its options in registries.
+func VerifySignature(ctx context.Context, registries *controller.Registries, ref, jwt, keyPath string) (string, error) {
+	key, err := utils.LoadVerifyingKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+	loc, err := model.ParseImageLocation(ref)
+	if err != nil {
+		return "", err
+	}
+	if loc.Registry, err = addProperScheme(ctx, registries, loc.Registry); err != nil {
+		return "", err
+	}
+
+	sc, err := controller.NewSignatureController(ctx, loc, jwt, registries)
+	if err != nil {
+		return "", err
+	}
+	dgst, err := sc.Resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := sc.Verify(ctx, dgst, key); err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
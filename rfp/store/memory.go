@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Memory is a Store keeping everything in memory, it is safe for
+// concurrent use.
+type Memory struct {
+	blobs     *memoryBlobs
+	manifests *memoryManifests
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		blobs:     &memoryBlobs{blobs: make(map[string][]byte)},
+		manifests: &memoryManifests{manifests: make(map[string]memoryManifest), tags: make(map[string]string)},
+	}
+}
+
+func (m *Memory) Blobs() BlobStore {
+	return m.blobs
+}
+
+func (m *Memory) Manifests() ManifestStore {
+	return m.manifests
+}
+
+type memoryBlobs struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func (mb *memoryBlobs) Stat(ctx context.Context, dgst string) (int64, bool, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	content, ok := mb.blobs[dgst]
+	return int64(len(content)), ok, nil
+}
+
+func (mb *memoryBlobs) Open(ctx context.Context, dgst string) (io.ReadCloser, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	content, ok := mb.blobs[dgst]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (mb *memoryBlobs) Put(ctx context.Context, dgst string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	actual, err := digest.FromBytes(content)
+	if err != nil {
+		return err
+	}
+	if actual.String() != dgst {
+		return fmt.Errorf("blob %s has digest %s", dgst, actual)
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.blobs[dgst] = content
+	return nil
+}
+
+// Mount shares the blob if from is in memory too.
+func (mb *memoryBlobs) Mount(ctx context.Context, dgst string, from BlobStore) (bool, error) {
+	src, ok := from.(*memoryBlobs)
+	if !ok || src == mb {
+		return false, nil
+	}
+
+	src.mu.RLock()
+	content, ok := src.blobs[dgst]
+	src.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.blobs[dgst] = content
+	return true, nil
+}
+
+// memoryManifest is a manifest kept in memory
+type memoryManifest struct {
+	content   []byte
+	mediaType string
+}
+
+type memoryManifests struct {
+	mu        sync.RWMutex
+	manifests map[string]memoryManifest
+	tags      map[string]string
+}
+
+func (mm *memoryManifests) Get(ctx context.Context, ref string) ([]byte, string, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	if dgst, ok := mm.tags[ref]; ok {
+		ref = dgst
+	}
+	manifest, ok := mm.manifests[ref]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return manifest.content, manifest.mediaType, nil
+}
+
+func (mm *memoryManifests) Stat(ctx context.Context, ref string) (string, bool, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	if dgst, ok := mm.tags[ref]; ok {
+		ref = dgst
+	}
+	if _, ok := mm.manifests[ref]; !ok {
+		return "", false, nil
+	}
+	return ref, true, nil
+}
+
+func (mm *memoryManifests) Put(ctx context.Context, ref string, content []byte, mediaType string) (string, error) {
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		return "", err
+	}
+	if IsDigest(ref) && ref != dgst.String() {
+		return "", fmt.Errorf("manifest %s has digest %s", ref, dgst)
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.manifests[dgst.String()] = memoryManifest{content: content, mediaType: mediaType}
+	if !IsDigest(ref) {
+		mm.tags[ref] = dgst.String()
+	}
+	return dgst.String(), nil
+}
+
+func (mm *memoryManifests) Tags(ctx context.Context) ([]string, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	tags := make([]string, 0, len(mm.tags))
+	for tag := range mm.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
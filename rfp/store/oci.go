@@ -0,0 +1,299 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+// OCILayout is a Store in an OCI image layout directory, the tags are the
+// ref.name annotations of the manifests in index.json.
+type OCILayout struct {
+	dir string
+
+	// mu guards index.json
+	mu sync.Mutex
+}
+
+func NewOCILayout(dir string) *OCILayout {
+	return &OCILayout{dir: dir}
+}
+
+// Dir returns the OCI image layout directory
+func (l *OCILayout) Dir() string {
+	return l.dir
+}
+
+func (l *OCILayout) Blobs() BlobStore {
+	return ociBlobs{l}
+}
+
+func (l *OCILayout) Manifests() ManifestStore {
+	return ociManifests{l}
+}
+
+// blobPath returns the file of the blob dgst
+func (l *OCILayout) blobPath(dgst string) (string, error) {
+	d, err := digest.ParseDigest(dgst)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, "blobs", string(d.Algorithm()), d.Hex()), nil
+}
+
+// init creates the directory of blobs and the oci-layout file if missing.
+func (l *OCILayout) init() error {
+	if err := os.MkdirAll(filepath.Join(l.dir, "blobs", string(digest.SHA256)), 0755); err != nil {
+		return err
+	}
+	layoutPath := filepath.Join(l.dir, "oci-layout")
+	if _, err := os.Stat(layoutPath); err == nil {
+		return nil
+	}
+	layout, err := json.Marshal(model.OCILayout{ImageLayoutVersion: model.OCILayoutVersion})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(layoutPath, layout, 0644)
+}
+
+// readIndex reads index.json, which is empty if it does not exist yet.
+func (l *OCILayout) readIndex() (model.OCIIndex, error) {
+	index := model.OCIIndex{SchemaVersion: 2, MediaType: model.MediaTypeOCIIndex}
+	indexPath := filepath.Join(l.dir, "index.json")
+	data, err := ioutil.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("error parse %s: %s", indexPath, err)
+	}
+	return index, nil
+}
+
+func (l *OCILayout) writeIndex(index model.OCIIndex) error {
+	if index.Manifests == nil {
+		index.Manifests = []model.Descriptor{}
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(l.dir, "index.json"), data, 0644)
+}
+
+type ociBlobs struct {
+	*OCILayout
+}
+
+func (b ociBlobs) Stat(ctx context.Context, dgst string) (int64, bool, error) {
+	path, err := b.blobPath(dgst)
+	if err != nil {
+		return 0, false, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), true, nil
+}
+
+func (b ociBlobs) Open(ctx context.Context, dgst string) (io.ReadCloser, error) {
+	path, err := b.blobPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Put writes the blob into a temporary file first, which is renamed once
+// its digest is checked.
+func (b ociBlobs) Put(ctx context.Context, dgst string, r io.Reader) error {
+	path, err := b.blobPath(dgst)
+	if err != nil {
+		return err
+	}
+	d, _ := digest.ParseDigest(dgst)
+	if d.Algorithm() != digest.SHA256 {
+		return fmt.Errorf("unsupported digest %s, only sha256 blobs can be stored", dgst)
+	}
+	if err := b.init(); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := digest.NewDigest(digest.SHA256, h); actual != d {
+		return fmt.Errorf("blob %s has digest %s", dgst, actual)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Mount is not supported by OCI image layout, the blobs are always copied.
+func (b ociBlobs) Mount(ctx context.Context, dgst string, from BlobStore) (bool, error) {
+	return false, nil
+}
+
+type ociManifests struct {
+	*OCILayout
+}
+
+func (m ociManifests) Get(ctx context.Context, ref string) ([]byte, string, error) {
+	m.mu.Lock()
+	index, err := m.readIndex()
+	m.mu.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var desc *model.Descriptor
+	for i := range index.Manifests {
+		d := &index.Manifests[i]
+		if d.Digest == ref || d.Annotations[model.OCIRefNameAnnotation] == ref {
+			desc = d
+		}
+	}
+	if desc == nil && !IsDigest(ref) {
+		return nil, "", ErrNotFound
+	}
+
+	dgst, mediaType := ref, ""
+	if desc != nil {
+		dgst, mediaType = desc.Digest, desc.MediaType
+	}
+	path, err := m.blobPath(dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mediaType == "" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(content, &versioned)
+		mediaType = versioned.MediaType
+	}
+	return content, mediaType, nil
+}
+
+func (m ociManifests) Stat(ctx context.Context, ref string) (string, bool, error) {
+	m.mu.Lock()
+	index, err := m.readIndex()
+	m.mu.Unlock()
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Digest == ref || desc.Annotations[model.OCIRefNameAnnotation] == ref {
+			return desc.Digest, true, nil
+		}
+	}
+	if !IsDigest(ref) {
+		return "", false, nil
+	}
+	_, exists, err := (ociBlobs{m.OCILayout}).Stat(ctx, ref)
+	return ref, exists, err
+}
+
+// Put writes the manifest as a blob, and also records it in index.json
+// if ref is a tag, replacing the manifest having the same tag.
+func (m ociManifests) Put(ctx context.Context, ref string, content []byte, mediaType string) (string, error) {
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		return "", err
+	}
+	if IsDigest(ref) && ref != dgst.String() {
+		return "", fmt.Errorf("manifest %s has digest %s", ref, dgst)
+	}
+	if err := (ociBlobs{m.OCILayout}).Put(ctx, dgst.String(), bytes.NewReader(content)); err != nil {
+		return "", err
+	}
+	if IsDigest(ref) {
+		return dgst.String(), nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index, err := m.readIndex()
+	if err != nil {
+		return "", err
+	}
+
+	manifests := []model.Descriptor{}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[model.OCIRefNameAnnotation] != ref {
+			manifests = append(manifests, desc)
+		}
+	}
+	index.Manifests = append(manifests, model.Descriptor{
+		MediaType:   mediaType,
+		Digest:      dgst.String(),
+		Size:        int64(len(content)),
+		Annotations: map[string]string{model.OCIRefNameAnnotation: ref},
+	})
+	if err := m.writeIndex(index); err != nil {
+		return "", err
+	}
+	return dgst.String(), nil
+}
+
+func (m ociManifests) Tags(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	index, err := m.readIndex()
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for _, desc := range index.Manifests {
+		if tag := desc.Annotations[model.OCIRefNameAnnotation]; tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
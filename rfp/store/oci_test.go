@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+func digestOf(t *testing.T, content []byte) string {
+	dgst, err := digest.FromBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dgst.String()
+}
+
+// readIndexFile reads index.json of the OCI image layout in dir
+func readIndexFile(t *testing.T, dir string) model.OCIIndex {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index model.OCIIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatalf("error parse index.json: %s", err)
+	}
+	return index
+}
+
+func TestOCILayoutBlobs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobs := NewOCILayout(dir).Blobs()
+
+	content := []byte("layer content")
+	dgst := digestOf(t, content)
+	if err := blobs.Put(ctx, dgst, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout")); err != nil {
+		t.Errorf("oci-layout not written: %s", err)
+	}
+
+	// a new OCILayout of the same directory sees the blob
+	blobs = NewOCILayout(dir).Blobs()
+	size, exists, err := blobs.Stat(ctx, dgst)
+	if err != nil || !exists || size != int64(len(content)) {
+		t.Errorf("Stat = %d, %t, %v, want %d, true", size, exists, err, len(content))
+	}
+	r, err := blobs.Open(ctx, dgst)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Open read %q, %v, want %q", got, err, content)
+	}
+
+	other := digestOf(t, []byte("other content"))
+	if err := blobs.Put(ctx, other, bytes.NewReader(content)); err == nil {
+		t.Error("Put of a blob with wrong digest succeeded")
+	}
+	if _, exists, err := blobs.Stat(ctx, other); err != nil || exists {
+		t.Errorf("Stat of missing blob = %t, %v, want false", exists, err)
+	}
+	if _, err := blobs.Open(ctx, other); err != ErrNotFound {
+		t.Errorf("Open of missing blob error = %v, want ErrNotFound", err)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "blobs", "sha256", ".put-*")); len(tmps) != 0 {
+		t.Errorf("temporary files left: %v", tmps)
+	}
+}
+
+func TestOCILayoutManifests(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	manifests := NewOCILayout(dir).Manifests()
+
+	v1 := []byte(`{"schemaVersion":2,"mediaType":"` + model.MediaTypeOCIManifest + `","layers":[]}`)
+	v2 := []byte(`{"schemaVersion":2,"mediaType":"` + model.MediaTypeDockerManifest + `","layers":[]}`)
+	for _, put := range []struct {
+		ref     string
+		content []byte
+	}{
+		{"1.0", v1},
+		{"latest", v1},
+		{"latest", v2},
+	} {
+		mediaType := model.MediaTypeOCIManifest
+		if bytes.Equal(put.content, v2) {
+			mediaType = model.MediaTypeDockerManifest
+		}
+		dgst, err := manifests.Put(ctx, put.ref, put.content, mediaType)
+		if err != nil {
+			t.Fatalf("Put %s: %s", put.ref, err)
+		}
+		if want := digestOf(t, put.content); dgst != want {
+			t.Errorf("Put %s = %s, want %s", put.ref, dgst, want)
+		}
+	}
+
+	// latest is replaced rather than added again
+	index := readIndexFile(t, dir)
+	want := []model.Descriptor{
+		{MediaType: model.MediaTypeOCIManifest, Digest: digestOf(t, v1), Size: int64(len(v1)),
+			Annotations: map[string]string{model.OCIRefNameAnnotation: "1.0"}},
+		{MediaType: model.MediaTypeDockerManifest, Digest: digestOf(t, v2), Size: int64(len(v2)),
+			Annotations: map[string]string{model.OCIRefNameAnnotation: "latest"}},
+	}
+	if !reflect.DeepEqual(index.Manifests, want) {
+		t.Errorf("index.json manifests = %+v, want %+v", index.Manifests, want)
+	}
+	if tags, err := manifests.Tags(ctx); err != nil || !reflect.DeepEqual(tags, []string{"1.0", "latest"}) {
+		t.Errorf("Tags = %v, %v, want [1.0 latest]", tags, err)
+	}
+
+	manifests = NewOCILayout(dir).Manifests()
+	for _, test := range []struct {
+		ref, mediaType string
+		content        []byte
+	}{
+		{"1.0", model.MediaTypeOCIManifest, v1},
+		{"latest", model.MediaTypeDockerManifest, v2},
+		{digestOf(t, v1), model.MediaTypeOCIManifest, v1},
+	} {
+		content, mediaType, err := manifests.Get(ctx, test.ref)
+		if err != nil {
+			t.Errorf("Get %s: %s", test.ref, err)
+			continue
+		}
+		if !bytes.Equal(content, test.content) || mediaType != test.mediaType {
+			t.Errorf("Get %s = %s, %s, want %s, %s", test.ref, content, mediaType, test.content, test.mediaType)
+		}
+		dgst, exists, err := manifests.Stat(ctx, test.ref)
+		if err != nil || !exists || dgst != digestOf(t, test.content) {
+			t.Errorf("Stat %s = %s, %t, %v, want %s, true", test.ref, dgst, exists, err, digestOf(t, test.content))
+		}
+	}
+
+	// a manifest put by digest is stored as a blob only
+	v3 := []byte(`{"schemaVersion":2,"mediaType":"` + model.MediaTypeOCIManifest + `","layers":[{}]}`)
+	if _, err := manifests.Put(ctx, digestOf(t, v3), v3, model.MediaTypeOCIManifest); err != nil {
+		t.Fatalf("Put by digest: %s", err)
+	}
+	if n := len(readIndexFile(t, dir).Manifests); n != 2 {
+		t.Errorf("index.json has %d manifests after Put by digest, want 2", n)
+	}
+	if content, mediaType, err := manifests.Get(ctx, digestOf(t, v3)); err != nil || !bytes.Equal(content, v3) || mediaType != model.MediaTypeOCIManifest {
+		t.Errorf("Get by digest = %s, %s, %v, want %s", content, mediaType, err, v3)
+	}
+	if _, err := manifests.Put(ctx, digestOf(t, v1), v3, model.MediaTypeOCIManifest); err == nil {
+		t.Error("Put of a manifest under another digest succeeded")
+	}
+
+	missing := digestOf(t, []byte("missing"))
+	for _, ref := range []string{"2.0", missing} {
+		if _, _, err := manifests.Get(ctx, ref); err != ErrNotFound {
+			t.Errorf("Get %s error = %v, want ErrNotFound", ref, err)
+		}
+		if _, exists, err := manifests.Stat(ctx, ref); err != nil || exists {
+			t.Errorf("Stat %s = %t, %v, want false", ref, exists, err)
+		}
+	}
+}
+
+func TestOCILayoutEmpty(t *testing.T) {
+	ctx := context.Background()
+	manifests := NewOCILayout(t.TempDir()).Manifests()
+	if tags, err := manifests.Tags(ctx); err != nil || len(tags) != 0 {
+		t.Errorf("Tags = %v, %v, want none", tags, err)
+	}
+	if _, _, err := manifests.Get(ctx, "latest"); err != ErrNotFound {
+		t.Errorf("Get error = %v, want ErrNotFound", err)
+	}
+}
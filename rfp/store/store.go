@@ -0,0 +1,63 @@
+// Package store abstracts where the blobs and manifests of images live,
+// like a repository in registry, an OCI image layout directory or memory.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/docker/distribution/digest"
+)
+
+// ErrNotFound is returned when a blob or manifest does not exist in a store
+var ErrNotFound = errors.New("not found")
+
+// BlobStore stores the blobs of a repository by their digest
+type BlobStore interface {
+
+	// Stat returns the size of the blob dgst, or false if it does not exist
+	Stat(ctx context.Context, dgst string) (int64, bool, error)
+
+	// Open opens the content of the blob dgst for reading, the caller must close it
+	Open(ctx context.Context, dgst string) (io.ReadCloser, error)
+
+	// Put stores the content read from r as the blob dgst, which must
+	// be the digest of the content
+	Put(ctx context.Context, dgst string, r io.Reader) error
+
+	// Mount makes the blob dgst of from available in the store without
+	// copying its content, it returns false if the store cannot do so
+	Mount(ctx context.Context, dgst string, from BlobStore) (bool, error)
+}
+
+// ManifestStore stores the manifests of a repository by tag and digest
+type ManifestStore interface {
+
+	// Get returns the content and media type of the manifest of ref,
+	// a tag or a digest
+	Get(ctx context.Context, ref string) ([]byte, string, error)
+
+	// Stat returns the digest of the manifest of ref, a tag or a digest,
+	// or false if it does not exist, without loading the manifest
+	Stat(ctx context.Context, ref string) (string, bool, error)
+
+	// Put stores the manifest content of mediaType under ref, a tag
+	// or a digest, returning the digest of the stored manifest
+	Put(ctx context.Context, ref string, content []byte, mediaType string) (string, error)
+
+	// Tags returns the tags of the store
+	Tags(ctx context.Context) ([]string, error)
+}
+
+// Store is a repository holding both blobs and manifests
+type Store interface {
+	Blobs() BlobStore
+	Manifests() ManifestStore
+}
+
+// IsDigest tells whether ref is a digest rather than a tag
+func IsDigest(ref string) bool {
+	_, err := digest.ParseDigest(ref)
+	return err == nil
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/model"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Decompress returns the uncompressed content of a layer blob read from r,
+// which may be gzip or zstd compressed or not, and the compression found.
+// The returned reader must be closed.
+func Decompress(r io.Reader) (io.ReadCloser, model.Compression, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return gz, model.CompressionGzip, nil
+	case bytes.Equal(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), model.CompressionZstd, nil
+	}
+	return ioutil.NopCloser(br), model.CompressionNone, nil
+}
+
+// Compress returns a writer compressing the content written into it as rc
+// into w, it must be closed to flush the compressed content. The same
+// content always gives the same compressed content.
+func Compress(w io.Writer, rc model.Recompression) (io.WriteCloser, error) {
+	switch rc.Compression {
+	case model.CompressionGzip:
+		level := gzip.DefaultCompression
+		if rc.Level != 0 {
+			level = rc.Level
+		}
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case model.CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if rc.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(rc.Level)))
+		}
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s", rc.Compression)
+}
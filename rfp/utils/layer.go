@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// WhiteoutPrefix marks a file removed from the lower layers in a layer tar
+const WhiteoutPrefix = ".wh."
+
+// layerModTime is the mtime of all the entries of built layers
+var layerModTime = time.Unix(0, 0)
+
+// layerEntry is an entry of a layer tar being built
+type layerEntry struct {
+	header  *tar.Header
+	content []byte
+}
+
+// BuildLayer writes a gzip compressed layer tar into w with the content of
+// src, a directory or a tar file, and a whiteout for each path of removals.
+// The entries are sorted, owned by root and have a fixed mtime, so the same
+// input always gives the same layer. The diff_id of the layer is returned.
+func BuildLayer(w io.Writer, src string, removals []string) (digest.Digest, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+
+	var entries []layerEntry
+	if info.IsDir() {
+		entries, err = readLayerDir(src)
+	} else {
+		entries, err = readLayerTar(src)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, removal := range removals {
+		name := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(removal)), "/")
+		if name == "" {
+			return "", fmt.Errorf("invalid path to remove %q", removal)
+		}
+		dir, base := path.Split(name)
+		entries = append(entries, layerEntry{header: &tar.Header{
+			Name:     dir + WhiteoutPrefix + base,
+			Typeflag: tar.TypeReg,
+		}})
+	}
+
+	// parents sort before their children when compared without the
+	// trailing slash of directories
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.TrimSuffix(entries[i].header.Name, "/") < strings.TrimSuffix(entries[j].header.Name, "/")
+	})
+
+	// the last one of the entries with the same name wins, like when
+	// extracting the tar
+	unique := entries[:0]
+	for _, entry := range entries {
+		if n := len(unique); n > 0 && unique[n-1].header.Name == entry.header.Name {
+			unique[n-1] = entry
+			continue
+		}
+		unique = append(unique, entry)
+	}
+
+	gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(gz, h))
+	for _, entry := range unique {
+		normalizeHeader(entry.header)
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(entry.content); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// readLayerDir returns the entries of the files under dir.
+func readLayerDir(dir string) ([]layerEntry, error) {
+	var entries []layerEntry
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		entry := layerEntry{header: header}
+		if info.Mode().IsRegular() {
+			if entry.content, err = ioutil.ReadFile(p); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// readLayerTar returns the entries of the tar file.
+func readLayerTar(file string) ([]layerEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []layerEntry
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error read %s: %s", file, err)
+		}
+
+		header.Name = strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if header.Name == "" {
+			continue
+		}
+		if header.Typeflag == tar.TypeDir {
+			header.Name += "/"
+		}
+		entry := layerEntry{header: header}
+		if entry.content, err = ioutil.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("error read %s: %s", file, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// normalizeHeader drops the attributes of an entry which depend on
+// where and when the layer is built.
+func normalizeHeader(header *tar.Header) {
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+	header.ModTime = layerModTime
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	header.Mode &= 07777
+	header.PAXRecords = nil
+	header.Format = tar.FormatUnknown
+}
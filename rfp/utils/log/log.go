@@ -1,114 +1,101 @@
+// Package log is the structured logging of rfp, based on logrus.
+//
+// The library does not log with a package global: it logs with the Logger
+// of the context of its calls, set by NewContext, so that the applications
+// choose the level, the format and the output of the logs, and the fields
+// they all carry, like the request id of a job.
 package log
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
-	"runtime"
-)
+	"time"
 
-const (
-	kCallDepth = 2
+	"github.com/Sirupsen/logrus"
 )
 
-type Logger struct {
-	wrapped     *log.Logger
-	debug       bool
-	exitOnFatal bool
-}
+// Logger logs the messages of at least its level with its fields,
+// WithField and WithFields return a Logger with more fields.
+type Logger = logrus.Entry
 
-var l *Logger
+// Fields are the fields of the messages of a Logger
+type Fields = logrus.Fields
 
-func init() {
-	l = &Logger{
-		wrapped: log.New(os.Stderr, "", log.LstdFlags),
-	}
-}
+// The names of the fields common to the messages of rfp
+const (
+	FieldRegistry   = "registry"
+	FieldRepository = "repository"
+	FieldDigest     = "digest"
+	FieldRequestID  = "request_id"
+	FieldDuration   = "duration"
+)
 
-func UnwrappedLogger() *log.Logger {
-	return l.wrapped
-}
+// The formats of the messages
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
 
-func EnableDebug() {
-	l.debug = true
-}
+// DefaultLevel is the level of the logs if not set
+const DefaultLevel = "info"
 
-func EnableExitOnFatal() {
-	l.exitOnFatal = true
-}
+// defaultLogger is the Logger of the contexts without one
+var defaultLogger, _ = New(os.Stderr, DefaultLevel, FormatText)
 
-func DebugV(v interface{}) {
-	Debugf("%+v", v)
-}
+// New creates a Logger writing to out the messages of at least level,
+// like debug or warn, in format.
+func New(out io.Writer, level, format string) (*Logger, error) {
+	l := logrus.New()
+	l.Out = out
 
-func Debug(v ...interface{}) {
-	if l.debug {
-		l.wrapped.Output(kCallDepth, header("DEBUG", fmt.Sprint(v...)))
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", level)
 	}
-}
-
-func Debugf(format string, v ...interface{}) {
-	if l.debug {
-		l.wrapped.Output(kCallDepth, header("DEBUG", fmt.Sprintf(format, v...)))
+	l.Level = lvl
+
+	switch format {
+	case FormatText, "":
+		l.Formatter = &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339}
+	case FormatJSON:
+		l.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be text or json", format)
 	}
+	return logrus.NewEntry(l), nil
 }
 
-func Info(v ...interface{}) {
-	l.wrapped.Output(kCallDepth, header("INFO", fmt.Sprint(v...)))
-}
-
-func Infof(format string, v ...interface{}) {
-	l.wrapped.Output(kCallDepth, header("INFO", fmt.Sprintf(format, v...)))
+// Discard returns a Logger dropping all the messages
+func Discard() *Logger {
+	l, _ := New(ioutil.Discard, "panic", FormatText)
+	return l
 }
 
-func Warn(v ...interface{}) {
-	l.wrapped.Output(kCallDepth, header("WARN", fmt.Sprint(v...)))
-}
+type loggerKey struct{}
 
-func Warnf(format string, v ...interface{}) {
-	l.wrapped.Output(kCallDepth, header("WARN", fmt.Sprintf(format, v...)))
+// NewContext returns a copy of ctx carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
 }
 
-func Error(v ...interface{}) {
-	l.wrapped.Output(kCallDepth, header("ERROR", fmt.Sprint(v...)))
-}
-
-func Errorf(format string, v ...interface{}) {
-	l.wrapped.Output(kCallDepth, header("ERROR", fmt.Sprintf(format, v...)))
-}
-
-func Fatal(v ...interface{}) {
-	msg := header("FATAL", fmt.Sprint(v...))
-	l.wrapped.Output(kCallDepth, msg)
-	if l.exitOnFatal {
-		os.Exit(1)
-	} else {
-		panic(msg)
+// FromContext returns the Logger of ctx, or one writing the messages
+// of at least info level to stderr if ctx carries none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
 	}
+	return defaultLogger
 }
 
-func Fatalf(format string, v ...interface{}) {
-	msg := header("FATAL", fmt.Sprintf(format, v...))
-	l.wrapped.Output(kCallDepth, msg)
-	if l.exitOnFatal {
-		os.Exit(1)
-	} else {
-		panic(msg)
-	}
+// WithFields returns a copy of ctx whose Logger has fields besides its own
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	return NewContext(ctx, FromContext(ctx).WithFields(fields))
 }
 
-func header(level, msg string) string {
-	_, file, line, ok := runtime.Caller(kCallDepth)
-	if ok {
-		file = filepath.Base(file)
-	}
-	if len(file) == 0 {
-		file = "???"
-	}
-	if line < 0 {
-		line = 0
-	}
-
-	return fmt.Sprintf("%s %s:%d: %s", level, file, line, msg)
+// Duration returns the value of the FieldDuration field of d
+func Duration(d time.Duration) string {
+	return d.String()
 }
@@ -0,0 +1,74 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, "warn", FormatJSON)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	l.Infof("dropped")
+	l.WithFields(Fields{FieldDigest: "sha256:abc", FieldDuration: Duration(1500 * time.Millisecond)}).Warnf("kept %d", 1)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("%d messages logged, want 1: %s", len(lines), buf.String())
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &msg); err != nil {
+		t.Fatalf("message is not JSON: %s", err)
+	}
+	for field, want := range map[string]string{
+		"level":       "warning",
+		"msg":         "kept 1",
+		FieldDigest:   "sha256:abc",
+		FieldDuration: "1.5s",
+	} {
+		if msg[field] != want {
+			t.Errorf("%s = %v, want %s", field, msg[field], want)
+		}
+	}
+
+	buf.Reset()
+	if l, err = New(&buf, "debug", FormatText); err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	l.WithField(FieldRegistry, "registry.example.com").Debugf("ready")
+	if out := buf.String(); !strings.Contains(out, "level=debug") || !strings.Contains(out, "registry=registry.example.com") {
+		t.Errorf("text message = %q", out)
+	}
+
+	if _, err := New(&buf, "verbose", FormatText); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if _, err := New(&buf, "info", "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != defaultLogger {
+		t.Error("context without logger does not log with the default one")
+	}
+
+	var buf bytes.Buffer
+	l, _ := New(&buf, "info", FormatJSON)
+	ctx := WithFields(NewContext(context.Background(), l), Fields{FieldRequestID: "42"})
+	FromContext(ctx).WithField(FieldRepository, "app").Infof("done")
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+		t.Fatalf("message is not JSON: %s", err)
+	}
+	if msg[FieldRequestID] != "42" || msg[FieldRepository] != "app" {
+		t.Errorf("message = %v, want the fields of the context and its own", msg)
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLimitedRead bounds the bytes read at once by a rate limited reader,
+// so the waits are spread over the transfer
+const maxLimitedRead = 32 << 10
+
+// Limiter is a token bucket limiting the rate of the bytes transferred,
+// it can be shared by concurrent transfers.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter of rate bytes per second, which lets a
+// tenth of a second of transfer, or maxLimitedRead at least, go at once.
+func NewLimiter(rate int64) *Limiter {
+	burst := float64(rate) / 10
+	if burst < maxLimitedRead {
+		burst = maxLimitedRead
+	}
+	return &Limiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// WaitN waits until n bytes may be transferred, or ctx is done.
+// The bytes are reserved at once, so the concurrent transfers get
+// their turns in order.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// LimitReader returns a reader of r whose bytes are read no faster than
+// every limiter allows, the nil ones being ignored. The reads fail once
+// ctx is done.
+func LimitReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	lr := &limitedReader{ctx: ctx, r: r}
+	for _, l := range limiters {
+		if l != nil {
+			lr.limiters = append(lr.limiters, l)
+		}
+	}
+	return lr
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedRead {
+		p = p[:maxLimitedRead]
+	}
+	n, err := lr.r.Read(p)
+	for _, l := range lr.limiters {
+		if werr := l.WaitN(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
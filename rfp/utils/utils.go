@@ -2,9 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/docker/distribution/manifest"
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/homedir"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/docker/runconfig"
 	"github.com/docker/libtrust"
@@ -19,6 +22,45 @@ func CreateTrustKey() (libtrust.PrivateKey, error) {
 	return trustKey, nil
 }
 
+// LoadOrCreateTrustKey loads the private key at path, which is in JWK format
+// if the file extension is .json or .jwk and in PEM format otherwise.
+// A new key is generated and saved to path if it does not exist yet, which
+// is told by the returned bool.
+func LoadOrCreateTrustKey(path string) (libtrust.PrivateKey, bool, error) {
+	trustKey, err := libtrust.LoadKeyFile(path)
+	if err == nil {
+		return trustKey, false, nil
+	}
+	if err != libtrust.ErrKeyFileDoesNotExist {
+		return nil, false, fmt.Errorf("error loading key file %s: %s", path, err)
+	}
+
+	if trustKey, err = CreateTrustKey(); err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, fmt.Errorf("error creating key directory: %s", err)
+	}
+	if err := libtrust.SaveKey(path, trustKey); err != nil {
+		return nil, false, fmt.Errorf("error saving key file %s: %s", path, err)
+	}
+	return trustKey, true, nil
+}
+
+// DockerConfigDir returns the directory of docker client configuration,
+// $DOCKER_CONFIG or ~/.docker by default.
+func DockerConfigDir() string {
+	if configDir := os.Getenv("DOCKER_CONFIG"); configDir != "" {
+		return configDir
+	}
+	return filepath.Join(homedir.Get(), ".docker")
+}
+
+// DefaultTrustKeyPath returns the location of the key.json of docker.
+func DefaultTrustKeyPath() string {
+	return filepath.Join(DockerConfigDir(), "key.json")
+}
+
 // Sign signs the manifest with the provided private key, returning a
 // SignedManifest.
 func Sign(m *manifest.Manifest, pk libtrust.PrivateKey) (*manifest.SignedManifest, error) {
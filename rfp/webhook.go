@@ -0,0 +1,162 @@
+package rfp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/utils/log"
+)
+
+const (
+	EventPushSucceeded = "push.succeeded"
+	EventPushFailed    = "push.failed"
+
+	// SignatureHeader holds the HMAC-SHA256 of the body of the webhook
+	// requests, keyed by the secret of the Webhook, as sha256=HEX
+	SignatureHeader = "X-RFP-Signature"
+
+	// DeliveryHeader holds the ID of the event, the same in every retry
+	DeliveryHeader = "X-RFP-Delivery"
+
+	EventHeader = "X-RFP-Event"
+
+	// webhookTimeout bounds each request to a webhook
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookBackoff is the wait before the first retry of a webhook,
+// doubled before each of the next ones
+var webhookBackoff = time.Second
+
+// Webhook is an HTTP endpoint notified of the result of each FakePush
+type Webhook struct {
+	URL string
+
+	// Secret, if set, signs the events in SignatureHeader
+	Secret string
+
+	// Retries is the count of the retries once the first request failed,
+	// either without response, or with a 429 or 5xx status code
+	Retries int
+}
+
+// WebhookEvent is the JSON body POSTed to the webhooks, the fields of
+// the Result of the FakePush are inlined.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Success   bool      `json:"success"`
+	Timestamp time.Time `json:"timestamp"`
+
+	*Result
+}
+
+// NewWebhookEvent creates the event reporting result
+func NewWebhookEvent(result *Result) *WebhookEvent {
+	e := &WebhookEvent{
+		ID:        newEventID(),
+		Event:     EventPushSucceeded,
+		Success:   result.Error == "",
+		Timestamp: time.Now().UTC(),
+		Result:    result,
+	}
+	if !e.Success {
+		e.Event = EventPushFailed
+	}
+	return e
+}
+
+// SignWebhookPayload returns the value of SignatureHeader for payload
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify sends the event of result to every webhook, the failures are
+// only logged since the push itself is already done. The webhooks are
+// still notified when ctx is done, as a canceled push is worth reporting.
+func (r *RegistryFakePusher) notify(ctx context.Context, result *Result) {
+	if len(r.Webhooks) == 0 {
+		return
+	}
+	event := NewWebhookEvent(result)
+	logger := log.FromContext(ctx)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Warnf("error encode webhook event: %s", err)
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	for _, hook := range r.Webhooks {
+		if err := hook.send(ctx, event, payload); err != nil {
+			logger.Warnf("error notify webhook %s: %s", hook.URL, err)
+		}
+	}
+}
+
+// send POSTs payload, retrying with an exponential backoff.
+func (w Webhook) send(ctx context.Context, event *WebhookEvent, payload []byte) error {
+	backoff := webhookBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if retry, err = w.post(ctx, event, payload); err == nil || !retry || attempt >= w.Retries {
+			return err
+		}
+		log.FromContext(ctx).Debugf("webhook %s failed, retry in %s: %s", w.URL, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends payload once, telling whether the failure is worth a retry
+func (w Webhook) post(ctx context.Context, event *WebhookEvent, payload []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Event)
+	req.Header.Set(DeliveryHeader, event.ID)
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, SignWebhookPayload(w.Secret, payload))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status_code=%v", resp.StatusCode)
+	}
+	return false, fmt.Errorf("status_code=%v", resp.StatusCode)
+}
+
+func newEventID() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,159 @@
+package rfp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp/rfptest"
+)
+
+// webhookReceiver records the events POSTed to it, failing the first
+// requests with the status codes of failures.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	failures  []int
+	events    []WebhookEvent
+	payloads  [][]byte
+	headers   []http.Header
+	attempts  int
+	delivered map[string]int
+}
+
+func newWebhookReceiver(failures ...int) *webhookReceiver {
+	wr := &webhookReceiver{failures: failures, delivered: make(map[string]int)}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload, _ := ioutil.ReadAll(req.Body)
+
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		wr.attempts++
+		wr.delivered[req.Header.Get(DeliveryHeader)]++
+		if len(wr.failures) > 0 {
+			status := wr.failures[0]
+			wr.failures = wr.failures[1:]
+			w.WriteHeader(status)
+			return
+		}
+		var event WebhookEvent
+		json.Unmarshal(payload, &event)
+		wr.events = append(wr.events, event)
+		wr.payloads = append(wr.payloads, payload)
+		wr.headers = append(wr.headers, req.Header)
+	}))
+	return wr
+}
+
+func withoutWebhookBackoff(t *testing.T) {
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	t.Cleanup(func() { webhookBackoff = backoff })
+}
+
+func TestWebhookOnSuccess(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	pusher := newTestPusher(t, reg, reg, "2")
+	pusher.Webhooks = []Webhook{{URL: receiver.URL, Secret: "s3cret"}}
+	result, err := pusher.FakePush(context.Background(), "", "", 1)
+	if err != nil {
+		t.Fatalf("FakePush: %s", err)
+	}
+
+	if len(receiver.events) != 1 {
+		t.Fatalf("%d events received, want 1", len(receiver.events))
+	}
+	event, header := receiver.events[0], receiver.headers[0]
+	if event.Event != EventPushSucceeded || !event.Success || event.Error != "" {
+		t.Errorf("event = %s, success %v, error %q", event.Event, event.Success, event.Error)
+	}
+	if event.Result == nil || event.Digest != result.Digest || len(event.Layers) != 1 {
+		t.Errorf("result not reported: %s", receiver.payloads[0])
+	}
+	if len(event.NewReferences) != 1 || event.NewReferences[0] != reg.Host()+"/base:2" {
+		t.Errorf("new references = %v", event.NewReferences)
+	}
+	if event.Duration <= 0 {
+		t.Errorf("duration = %s", event.Duration)
+	}
+	if got, want := header.Get(SignatureHeader), SignWebhookPayload("s3cret", receiver.payloads[0]); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if header.Get(EventHeader) != EventPushSucceeded || header.Get(DeliveryHeader) != event.ID {
+		t.Errorf("headers = %v", header)
+	}
+}
+
+func TestWebhookOnFailure(t *testing.T) {
+	reg := rfptest.NewRegistry()
+	defer reg.Close()
+	putTestImages(t, reg, reg)
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	// base:1 already exists and force is not given
+	pusher := newTestPusher(t, reg, reg, "1")
+	pusher.Webhooks = []Webhook{{URL: receiver.URL}}
+	if _, err := pusher.FakePush(context.Background(), "", "", 1); err == nil {
+		t.Fatal("FakePush overwrote an existing tag")
+	}
+
+	if len(receiver.events) != 1 {
+		t.Fatalf("%d events received, want 1", len(receiver.events))
+	}
+	event := receiver.events[0]
+	if event.Event != EventPushFailed || event.Success || event.Error == "" {
+		t.Errorf("event = %s, success %v, error %q", event.Event, event.Success, event.Error)
+	}
+	if receiver.headers[0].Get(SignatureHeader) != "" {
+		t.Error("event signed without secret")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	withoutWebhookBackoff(t)
+
+	for _, tc := range []struct {
+		name      string
+		failures  []int
+		retries   int
+		attempts  int
+		delivered bool
+	}{
+		{"retried until delivered", []int{500, 429}, 3, 3, true},
+		{"retries exhausted", []int{503, 503, 503}, 2, 3, false},
+		{"client error not retried", []int{400}, 3, 1, false},
+		{"no retries", []int{500}, 0, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(tc.failures...)
+			defer receiver.Close()
+
+			hook := Webhook{URL: receiver.URL, Retries: tc.retries}
+			event := NewWebhookEvent(&Result{Digest: "sha256:1"})
+			payload, _ := json.Marshal(event)
+			err := hook.send(context.Background(), event, payload)
+
+			if receiver.attempts != tc.attempts {
+				t.Errorf("%d attempts, want %d", receiver.attempts, tc.attempts)
+			}
+			if delivered := err == nil; delivered != tc.delivered {
+				t.Errorf("delivered = %v, want %v: %v", delivered, tc.delivered, err)
+			}
+			if n := receiver.delivered[event.ID]; n != tc.attempts {
+				t.Errorf("%d attempts with the delivery ID, want %d", n, tc.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+	"github.com/laincloud/registry-fake-pusher/rfp/server"
+)
+
+// shutdownTimeout bounds the wait for in-flight HTTP requests on shutdown
+const shutdownTimeout = 10 * time.Second
+
+func runServe(args []string) int {
+	var listen, keyPath, trustedKeys string
+	var logs logOptions
+	var rates rateOptions
+	var webhooks stringList
+	var webhookSecret string
+	var webhookRetries int
+	var opts server.Options
+
+	fs := newFlagSet("serve")
+	fs.StringVar(&listen, "listen", ":8080", "The address the HTTP API listens on")
+	fs.IntVar(&opts.Workers, "workers", 2, "The count of jobs run at the same time")
+	fs.IntVar(&opts.QueueSize, "queue", 16, "The count of jobs waiting to run, beyond which requests are refused")
+	fs.StringVar(&opts.StatePath, "state", "", "The file the jobs are persisted in (default kept in memory only)")
+	fs.DurationVar(&opts.Retention, "retention", 24*time.Hour, "How long finished jobs are kept, 0 for forever")
+	fs.DurationVar(&opts.JobTimeout, "job-timeout", 30*time.Minute, "Abort a job if it takes longer than this, 0 for no timeout")
+	fs.StringVar(&keyPath, "key", "", "The private key (JWK or PEM) signing the new manifests, generated if missing (default docker's key.json)")
+	fs.StringVar(&trustedKeys, "trusted-keys", "", "The public keys (JWK set or PEM bundle) the images built on must be signed by")
+	fs.BoolVar(&opts.AllowSkipVerify, "allow-skip-verify", false, "Let the requests disable the verification of the signatures with skipVerify")
+	fs.Var(&webhooks, "webhook", "POST the result of every job as a JSON event to this URL, may be given several times")
+	fs.StringVar(&webhookSecret, "webhook-secret", "", "The secret signing the webhook events with HMAC-SHA256")
+	fs.IntVar(&webhookRetries, "webhook-retries", 3, "The count of retries of a failed webhook request")
+	logs.addFlags(fs)
+	rates.addFlags(fs)
+
+	positional, registries, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 0 {
+		fmt.Fprintln(os.Stderr, "Error: serve takes no arguments")
+		fs.Usage()
+		return 1
+	}
+	if webhookRetries < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --webhook-retries must not be negative")
+		return 1
+	}
+	if err := rates.valid(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	logger, closeLog, err := logs.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer closeLog()
+	opts.Logger = logger
+	opts.Registries = registries
+
+	rateLimit := rates.limit()
+	opts.Configure = func(pusher *rfp.RegistryFakePusher) {
+		pusher.TrustKeyPath = keyPath
+		pusher.TrustedKeysPath = trustedKeys
+		pusher.Webhooks = newWebhooks(webhooks, webhookSecret, webhookRetries)
+		pusher.RateLimit = rateLimit
+	}
+	srv, err := server.New(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	ctx, cancel := newContext(0, logger)
+	defer cancel()
+	srv.Start(ctx)
+
+	httpServer := &http.Server{Addr: listen, Handler: srv}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- httpServer.ListenAndServe()
+	}()
+	logger.Infof("serving on %s", listen)
+
+	select {
+	case err := <-errc:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		cancel()
+		srv.Wait()
+		return 1
+	case <-ctx.Done():
+	}
+
+	logger.Infof("shutting down")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	httpServer.Shutdown(shutdownCtx)
+	srv.Wait()
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/laincloud/registry-fake-pusher/rfp"
+)
+
+func runVerify(args []string) int {
+	var keyPath, jwt string
+	var timeout time.Duration
+	var logs logOptions
+
+	fs := newFlagSet("verify")
+	fs.StringVar(&keyPath, "key", "", "The ECDSA or ed25519 public key (PEM) the signature must be made with")
+	fs.StringVar(&jwt, "jwt", "", "The JWT used to access the registry and repository")
+	fs.DurationVar(&timeout, "timeout", 0, "Abort the verification if it takes longer than this (default no timeout)")
+	logs.addFlags(fs)
+
+	refs, registries, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 1
+	}
+	if len(refs) != 1 || keyPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --key and IMAGE_REF are required")
+		fs.Usage()
+		return 1
+	}
+
+	logger, closeLog, err := logs.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer closeLog()
+
+	ctx, cancel := newContext(timeout, logger)
+	defer cancel()
+
+	dgst, err := rfp.VerifySignature(ctx, registries, refs[0], jwt, keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Verification failed:", err)
+		return 2
+	}
+
+	fmt.Printf("Verified OK: %s@%s\n", refs[0], dgst)
+	return 0
+}